@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestAdminListener(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	startBackend(t, api, map[string]string{
+		"BACKEND_APPROVED_CLIENT_SPIFFEID": testWebID,
+		"BACKEND_ADMIN_ADDR":               adminAddr,
+	})
+
+	// Probes need no client certificate
+	resp, err := http.Get("http://" + adminAddr + "/readyz")
+	if err != nil {
+		t.Fatalf("Readiness probe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Status != "ready" {
+		t.Errorf("Expected the backend to be ready, got %d %+v", resp.StatusCode, body)
+	}
+	for _, check := range []string{"startup", "workload_api", "svid", "trust_bundle"} {
+		if body.Checks[check] != "ok" {
+			t.Errorf("Expected check %s to pass, got %q", check, body.Checks[check])
+		}
+	}
+}
+
+func TestAdminListenerDuringStartup(t *testing.T) {
+	api := workloadtest.New(t, testBackendID)
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	t.Setenv("BACKEND_APPROVED_CLIENT_SPIFFEID", testWebID)
+	t.Setenv("BACKEND_PORT", fmt.Sprint(freePort(t)))
+	t.Setenv("BACKEND_ADMIN_ADDR", adminAddr)
+	t.Setenv("BACKEND_WORKLOAD_API_WAIT", "1m")
+
+	// The Workload API issues no SVID, so the backend keeps waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, []string{"-workload-socket", api.NoIdentityAddr()}) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + adminAddr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected liveness to pass while waiting for an SVID, got %d", resp.StatusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the admin listener before the SVID, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get("http://" + adminAddr + "/readyz")
+	if err != nil {
+		t.Fatalf("Readiness probe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Checks["startup"] == "ok" {
+		t.Errorf("Expected readiness to fail until the SVID arrives, got %d %+v", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/metrics"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Audit event types and outcomes.
+const (
+	AuditTLSHandshake  = "tls_handshake"
+	AuditAuthorization = "authorization"
+
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditAllow   = "allow"
+	AuditDeny    = "deny"
+)
+
+// AuditEvent is one line of the audit log.
+type AuditEvent struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Outcome       string    `json:"outcome"`
+	RemoteAddr    string    `json:"remote_addr"`
+	PeerSPIFFEID  string    `json:"peer_spiffe_id,omitempty"`
+	PeerSerial    string    `json:"peer_serial,omitempty"`
+	AuthMethod    string    `json:"auth_method,omitempty"`
+	Method        string    `json:"method,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	Route         string    `json:"route,omitempty"`
+	PolicyVersion string    `json:"policy_version,omitempty"`
+	Reason        string    `json:"reason,omitempty"` // Classified failure, such as unknown_authority
+	Detail        string    `json:"detail,omitempty"` // Error as reported by TLS or the policy
+}
+
+// AuditLog writes the authentication and authorization decisions of the
+// backend as JSON lines, so that it can be proven which workload accessed
+// what. Events are only ever appended.
+type AuditLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// newAuditLog writes events to w.
+func newAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// openAuditLog writes events to stdout for "stdout" or "-", and otherwise
+// appends them to the file at dest.
+func openAuditLog(dest string) (*AuditLog, error) {
+	if dest == "stdout" || dest == "-" {
+		return newAuditLog(os.Stdout), nil
+	}
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return &AuditLog{w: file, closer: file}, nil
+}
+
+// Record appends event, stamping it with the current time. Failing to write
+// is logged, but never fails the request being audited.
+func (a *AuditLog) Record(event AuditEvent) {
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode audit event", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit event", "error", err)
+	}
+}
+
+// Close closes the audit log file, if any.
+func (a *AuditLog) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// authorizationEvent describes decision on r under the given policy version.
+func authorizationEvent(version string, r *http.Request, decision Decision) AuditEvent {
+	event := AuditEvent{
+		Event:         AuditAuthorization,
+		Outcome:       AuditAllow,
+		RemoteAddr:    r.RemoteAddr,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Route:         decision.Route,
+		PolicyVersion: version,
+	}
+	if caller, ok := identity.CallerFromContext(r.Context()); ok {
+		event.PeerSPIFFEID = caller.ID.String()
+		event.AuthMethod = caller.AuthMethod
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		event.PeerSerial = r.TLS.PeerCertificates[0].SerialNumber.Text(16)
+	}
+	if !decision.Allowed {
+		event.Outcome = AuditDeny
+		event.Reason = "forbidden"
+		if decision.Status == http.StatusUnauthorized {
+			event.Reason = "unauthenticated"
+		}
+		event.Detail = decision.Reason
+	}
+	return event
+}
+
+// observeHandshake records the outcome of the TLS handshake of conn, with
+// the certificate the client presented, if any.
+func (a *AuditLog) observeHandshake(conn *tls.Conn, err error) {
+	event := AuditEvent{Event: AuditTLSHandshake, Outcome: AuditSuccess, RemoteAddr: conn.RemoteAddr().String()}
+	// The certificates are kept when their verification fails
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		event.PeerSerial = certs[0].SerialNumber.Text(16)
+		if id, idErr := x509svid.IDFromCert(certs[0]); idErr == nil {
+			event.PeerSPIFFEID = id.String()
+			event.AuthMethod = identity.AuthMethodX509SVID
+		}
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Reason = metrics.HandshakeErrorReason(err)
+		event.Detail = err.Error()
+	}
+	a.Record(event)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+func TestAuditLog(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID, testIntruderID)
+	policies, err := newPolicyStore(Policy{
+		Version:         "v1",
+		ApprovedClients: []string{testWebID},
+		Routes:          RoutePolicy{"GET /whoami": {testWebID}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	var buf bytes.Buffer
+	audit := newAuditLog(&buf)
+	source := api.X509Source(t, testBackendID)
+	server := NewServer(Config{}, source, policies, nil)
+	server.SetMetrics(newMetrics(source, x509bundle.NewSet()))
+	server.SetAuditLog(audit)
+	policies.SetAuditLog(audit)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	web := mtlsClient(t, api, testWebID)
+	for _, path := range []string{"/whoami", "/"} {
+		resp, err := web.Get(url + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := mtlsClient(t, api, testIntruderID).Get(url + "/whoami"); err == nil {
+		t.Error("Expected a client that is not approved to be rejected")
+	}
+
+	// A workload whose SVID was issued by a different CA is rejected, even
+	// though it trusts the backend
+	foreign := workloadtest.New(t, testWebID).X509Source(t, testWebID)
+	trusted := api.X509Source(t, testWebID)
+	foreignClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: tlsconfig.MTLSClientConfig(foreign, trusted, tlsconfig.AuthorizeID(spiffeid.RequireFromString(testBackendID))),
+	}}
+	if _, err := foreignClient.Get(url + "/whoami"); err == nil {
+		t.Error("Expected a client of an unknown authority to be rejected")
+	}
+
+	type key struct{ event, outcome, peer, reason, route string }
+	expected := []key{
+		{AuditTLSHandshake, AuditSuccess, testWebID, "", ""},
+		{AuditAuthorization, AuditAllow, testWebID, "", "GET /whoami"},
+		{AuditAuthorization, AuditDeny, testWebID, "forbidden", ""},
+		{AuditTLSHandshake, AuditFailure, testIntruderID, "unauthorized", ""},
+		{AuditTLSHandshake, AuditFailure, testWebID, "unknown_authority", ""},
+	}
+
+	// The server records a failed handshake after the client has seen it fail
+	var seen map[key]int
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		audit.mu.Lock()
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		audit.mu.Unlock()
+
+		seen = map[key]int{}
+		for _, line := range lines {
+			var event AuditEvent
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("Expected JSON lines, got %q: %v", line, err)
+			}
+			if event.Time.IsZero() || event.RemoteAddr == "" {
+				t.Errorf("Expected a time and remote address, got %+v", event)
+			}
+			if event.Event == AuditAuthorization && event.PolicyVersion != "v1" {
+				t.Errorf("Expected policy version v1, got %+v", event)
+			}
+			seen[key{event.Event, event.Outcome, event.PeerSPIFFEID, event.Reason, event.Route}]++
+		}
+		if len(seen) >= len(expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, k := range expected {
+		if seen[k] == 0 {
+			t.Errorf("Expected an event %+v, got %v", k, seen)
+		}
+	}
+	if seen[expected[3]] > 1 {
+		t.Errorf("Expected the rejected handshake to be recorded once, got %d", seen[expected[3]])
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		audit, err := openAuditLog(path)
+		if err != nil {
+			t.Fatalf("Failed to open audit log: %v", err)
+		}
+		audit.Record(AuditEvent{Event: AuditAuthorization, Outcome: AuditAllow})
+		audit.Close()
+	}
+
+	// Reopening appends instead of truncating
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d: %s", lines, data)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestApprovedClientsAuthorizer(t *testing.T) {
+	store, err := newPolicyStore(Policy{ApprovedClients: []string{
+		"spiffe://example.com/web",
+		"spiffe://example.com/batch",
+	}})
+	if err != nil {
+		t.Fatalf("Expected valid IDs, got error: %v", err)
+	}
+
+	for _, allowed := range []string{"spiffe://example.com/web", "spiffe://example.com/batch"} {
+		if err := store.Authorize(spiffeid.RequireFromString(allowed), nil); err != nil {
+			t.Errorf("Expected %s to be authorized, got %v", allowed, err)
+		}
+	}
+
+	if err := store.Authorize(spiffeid.RequireFromString("spiffe://example.com/other"), nil); err == nil {
+		t.Error("Expected unlisted SPIFFE ID to be rejected")
+	}
+}
+
+func TestApprovedClientsInvalid(t *testing.T) {
+	if _, err := newPolicyStore(Policy{}); err == nil {
+		t.Error("Expected error for empty approved list")
+	}
+
+	_, err := newPolicyStore(Policy{ApprovedClients: []string{"not-a-spiffe-id", "spiffe://example.com/web", "spiffe://EXAMPLE/bad"}})
+	if err == nil {
+		t.Fatal("Expected error for malformed IDs")
+	}
+	for _, bad := range []string{"not-a-spiffe-id", "spiffe://EXAMPLE/bad"} {
+		if !strings.Contains(err.Error(), bad) {
+			t.Errorf("Expected error to mention %q, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/authz"
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/meinsta/workload-id-demo/shared/workload"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// configVersion is the version of the config file format understood by this
+// build.
+const configVersion = 1
+
+// Config is the effective configuration of the backend. It starts from
+// defaultConfig, then the config file, then the BACKEND_* environment
+// variables and finally the command line flags are applied on top:
+//
+//	version: 1
+//	workload_socket: unix:///opt/machine-id/backend.sock
+//	port: "8443"
+//	approved_clients:
+//	  - spiffe://example.com/web
+//	log:
+//	  format: json
+type Config struct {
+	Version                 int                      `yaml:"version"`
+	WorkloadSocket          string                   `yaml:"workload_socket"`
+	ApprovedClientSPIFFEIDs []string                 `yaml:"approved_clients"`
+	Name                    string                   `yaml:"name"`
+	Infra                   string                   `yaml:"infra"`
+	Port                    string                   `yaml:"port"`
+	AdminAddr               string                   `yaml:"admin_addr"`             // Plain-HTTP listener for probes and build info
+	RoutePolicy             RoutePolicy              `yaml:"route_policy,omitempty"` // Empty allows every approved client on every route
+	PolicyFile              string                   `yaml:"policy_file"`            // YAML/JSON Policy file, replaces the two settings above and is hot-reloaded
+	PolicyReloadInterval    time.Duration            `yaml:"policy_reload_interval"`
+	ShutdownDelay           time.Duration            `yaml:"shutdown_delay"`        // How long /readyz fails before the listener closes, so load balancers deregister
+	ShutdownGracePeriod     time.Duration            `yaml:"shutdown_grace_period"` // How long in-flight requests may take to finish on shutdown
+	ShadowPolicyFile        string                   `yaml:"shadow_policy_file"`    // Candidate Policy file evaluated in log-only mode
+	JWTAudience             string                   `yaml:"jwt_audience"`          // Enables JWT-SVID bearer authentication for this audience
+	AuditLog                string                   `yaml:"audit_log"`             // File that handshakes and authorization decisions are appended to, or "stdout"
+	Watchdog                svidwatch.WatchdogConfig `yaml:"watchdog"`
+	WorkloadAPIWait         workload.WaitConfig      `yaml:"workload_api_wait"`
+	Log                     telemetry.LogConfig      `yaml:"log"`
+	Trace                   telemetry.TraceConfig    `yaml:"trace"`
+}
+
+// defaultConfig is used for everything the config file, the environment and
+// the flags leave unset.
+func defaultConfig() Config {
+	return Config{
+		Version:              configVersion,
+		WorkloadSocket:       "unix://testing/.cache/sockets/backend.sock", // Repo-local socket for local demo
+		Port:                 "8443",
+		AdminAddr:            ":9091",
+		PolicyReloadInterval: 5 * time.Second,
+		ShutdownDelay:        5 * time.Second,
+		ShutdownGracePeriod:  10 * time.Second,
+		Watchdog:             svidwatch.DefaultWatchdogConfig(),
+		WorkloadAPIWait:      workload.DefaultWaitConfig(),
+		Log:                  telemetry.LogConfig{Format: "text", Level: "info"},
+		Trace:                telemetry.TraceConfig{Exporter: "none", ServiceName: "backend"},
+	}
+}
+
+// loadConfig builds the effective config from args and the environment, and
+// the authorization policy it names. The config file is named by -config or
+// BACKEND_CONFIG_FILE. checkOnly reports whether -check-config was given.
+func loadConfig(args []string) (config Config, policies *PolicyStore, checkOnly bool, err error) {
+	flags := flag.NewFlagSet("backend", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("BACKEND_CONFIG_FILE"), "Versioned YAML config file")
+	workloadSocket := flags.String("workload-socket", "", "Workload API socket address")
+	check := flags.Bool("check-config", false, "Print the effective config and exit, non-zero if it is invalid")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, false, err
+	}
+
+	config = defaultConfig()
+	if *configFile != "" {
+		if err := configfile.Load(*configFile, &config, &config.Version, configVersion); err != nil {
+			return config, nil, *check, err
+		}
+	}
+	if err := applyEnv(&config); err != nil {
+		return config, nil, *check, err
+	}
+	if *workloadSocket != "" {
+		config.WorkloadSocket = *workloadSocket
+	}
+	policies, err = config.validate()
+	return config, policies, *check, err
+}
+
+// applyEnv overrides config with the environment variables that are set.
+func applyEnv(config *Config) error {
+	// BACKEND_SOCKET_PATH is the legacy name of WORKLOAD_API_SOCKET
+	if socket := workload.SocketFromEnv("BACKEND_SOCKET_PATH", "WORKLOAD_API_SOCKET"); socket != "" {
+		config.WorkloadSocket = socket
+	}
+	for key, field := range map[string]*string{
+		"BACKEND_NAME":               &config.Name,
+		"BACKEND_INFRA":              &config.Infra,
+		"BACKEND_PORT":               &config.Port,
+		"BACKEND_ADMIN_ADDR":         &config.AdminAddr,
+		"BACKEND_POLICY_FILE":        &config.PolicyFile,
+		"BACKEND_SHADOW_POLICY_FILE": &config.ShadowPolicyFile,
+		"BACKEND_JWT_AUDIENCE":       &config.JWTAudience,
+		"BACKEND_AUDIT_LOG":          &config.AuditLog,
+		"BACKEND_LOG_FORMAT":         &config.Log.Format,
+		"BACKEND_LOG_LEVEL":          &config.Log.Level,
+		"BACKEND_TRACE_EXPORTER":     &config.Trace.Exporter,
+	} {
+		if value := os.Getenv(key); value != "" {
+			*field = value
+		}
+	}
+	if value := os.Getenv("BACKEND_APPROVED_CLIENT_SPIFFEID"); value != "" {
+		config.ApprovedClientSPIFFEIDs = authz.SplitList(value)
+	}
+	if value := os.Getenv("BACKEND_ROUTE_POLICY"); value != "" {
+		routes, err := parseRoutePolicy(value)
+		if err != nil {
+			return fmt.Errorf("invalid BACKEND_ROUTE_POLICY: %w", err)
+		}
+		config.RoutePolicy = routes
+	}
+	for key, field := range map[string]*time.Duration{
+		"BACKEND_POLICY_RELOAD_INTERVAL": &config.PolicyReloadInterval,
+		"BACKEND_SHUTDOWN_DELAY":         &config.ShutdownDelay,
+		"BACKEND_SHUTDOWN_GRACE_PERIOD":  &config.ShutdownGracePeriod,
+	} {
+		if value := os.Getenv(key); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			*field = duration
+		}
+	}
+	if err := svidwatch.ParseWatchdogConfig("BACKEND", &config.Watchdog); err != nil {
+		return err
+	}
+	return workload.ParseWaitConfig("BACKEND", &config.WorkloadAPIWait)
+}
+
+// validate reports every invalid setting at once. The policy and the shadow
+// policy are checked by loading them, so the store is returned for the server
+// to use rather than reading the policy files a second time.
+func (c Config) validate() (*PolicyStore, error) {
+	var errs []error
+	if err := workloadapi.ValidateAddress(c.WorkloadSocket); err != nil {
+		errs = append(errs, fmt.Errorf("workload_socket %q: %w", c.WorkloadSocket, err))
+	}
+	if err := configfile.ValidatePort(c.Port); err != nil {
+		errs = append(errs, fmt.Errorf("port: %w", err))
+	}
+	if err := configfile.ValidateListenAddr(c.AdminAddr); err != nil {
+		errs = append(errs, fmt.Errorf("admin_addr: %w", err))
+	}
+	if c.PolicyReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("policy_reload_interval must be positive, got %v", c.PolicyReloadInterval))
+	}
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_delay must not be negative, got %v", c.ShutdownDelay))
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace_period must not be negative, got %v", c.ShutdownGracePeriod))
+	}
+	if err := c.Watchdog.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("watchdog: %w", err))
+	}
+	if err := c.WorkloadAPIWait.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("workload_api_wait: %w", err))
+	}
+	if _, err := telemetry.NewLogger(io.Discard, c.Log); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if err := c.Trace.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("trace: %w", err))
+	}
+	policies, err := loadPolicyStore(c)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if c.PolicyFile != "" && (len(c.ApprovedClientSPIFFEIDs) > 0 || len(c.RoutePolicy) > 0) {
+		errs = append(errs, errors.New("approved_clients and route_policy would be ignored, policy_file replaces them"))
+	}
+	if c.ShadowPolicyFile != "" {
+		candidate, err := newPolicyStoreFromFile(c.ShadowPolicyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shadow_policy_file: %w", err))
+		} else if policies != nil {
+			policies.SetShadow(newShadowPolicy(candidate))
+		}
+	}
+	return policies, errors.Join(errs...)
+}
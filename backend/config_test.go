@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backend.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+version: 1
+workload_socket: unix:///run/backend.sock
+name: Backend (file)
+port: "9443"
+approved_clients:
+  - spiffe://example.com/web
+route_policy:
+  "GET /whoami": ["spiffe://example.com/web"]
+policy_reload_interval: 30s
+watchdog:
+  warn_threshold: 5m
+log:
+  format: json
+`)
+	// The environment overrides the file, and flags the environment
+	t.Setenv("BACKEND_PORT", "10443")
+	t.Setenv("WORKLOAD_API_SOCKET", "unix:///run/env.sock")
+	config, policies, checkOnly, err := loadConfig([]string{"-config", path, "-workload-socket", "tcp://127.0.0.1:8081"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if checkOnly {
+		t.Error("Expected to serve without -check-config")
+	}
+
+	if config.Name != "Backend (file)" || config.Port != "10443" || config.WorkloadSocket != "tcp://127.0.0.1:8081" {
+		t.Errorf("Unexpected precedence in %+v", config)
+	}
+	if config.PolicyReloadInterval != 30*time.Second || config.Watchdog.Warn != 5*time.Minute || config.Log.Format != "json" {
+		t.Errorf("Expected the file settings, got %+v", config)
+	}
+	if config.Watchdog.Critical != svidwatch.DefaultWatchdogConfig().Critical || config.AdminAddr != ":9091" {
+		t.Errorf("Expected defaults for unset settings, got %+v", config)
+	}
+	if len(config.RoutePolicy["GET /whoami"]) != 1 {
+		t.Errorf("Expected the route policy of the file, got %v", config.RoutePolicy)
+	}
+	if policies == nil || len(policies.Policy().Routes["GET /whoami"]) != 1 {
+		t.Error("Expected the policy store built from the route policy")
+	}
+
+	// The printed config loads back to the same config
+	var buf bytes.Buffer
+	if err := configfile.Print(&buf, config); err != nil {
+		t.Fatalf("Failed to print config: %v", err)
+	}
+	reloaded := defaultConfig()
+	if err := configfile.Load(writeConfigFile(t, buf.String()), &reloaded, &reloaded.Version, configVersion); err != nil {
+		t.Fatalf("Failed to load printed config: %v\n%s", err, buf.String())
+	}
+	if reloaded.Port != config.Port || reloaded.Watchdog != config.Watchdog || reloaded.Log != config.Log {
+		t.Errorf("Expected %+v, got %+v", config, reloaded)
+	}
+}
+
+func TestLoadConfigShadowPolicy(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	writePolicyFile(t, valid, "version: candidate\napproved_clients: [spiffe://example.com/web]\n")
+	broken := filepath.Join(dir, "broken.yaml")
+	writePolicyFile(t, broken, "version: broken\napproved_clients: [spiffe://example.com/web/**/x]\n")
+
+	config := "version: 1\napproved_clients: [spiffe://example.com/web]\nshadow_policy_file: %s\n"
+	_, policies, _, err := loadConfig([]string{"-config", writeConfigFile(t, fmt.Sprintf(config, valid))})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if shadow := policies.Shadow(); shadow == nil || shadow.candidate.Policy().Version != "candidate" {
+		t.Errorf("Expected the shadow policy to be loaded with the config, got %+v", shadow)
+	}
+
+	// A broken shadow policy fails -check-config, naming the setting
+	_, _, checkOnly, err := loadConfig([]string{"-check-config", "-config", writeConfigFile(t, fmt.Sprintf(config, broken))})
+	if !checkOnly {
+		t.Error("Expected -check-config to be reported")
+	}
+	if err == nil || !strings.Contains(err.Error(), "shadow_policy_file") {
+		t.Errorf("Expected an error naming shadow_policy_file, got %v", err)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	testCases := map[string]struct {
+		file     string
+		expected []string
+	}{
+		"unknown_field": {
+			file:     "version: 1\napproved_client: [spiffe://example.com/web]\n",
+			expected: []string{"field approved_client not found"},
+		},
+		"missing_version": {
+			file:     "approved_clients: [spiffe://example.com/web]\n",
+			expected: []string{"has version 0"},
+		},
+		"future_version": {
+			file:     "version: 2\n",
+			expected: []string{"has version 2"},
+		},
+		"approved_clients_with_policy_file": {
+			file:     "version: 1\napproved_clients: [spiffe://example.com/web]\npolicy_file: /etc/backend/policy.yaml\n",
+			expected: []string{"policy_file replaces them"},
+		},
+		// Every invalid setting is reported at once
+		"invalid_settings": {
+			file: `
+version: 1
+workload_socket: /run/backend.sock
+port: "70000"
+admin_addr: "9091"
+approved_clients: [spiffe://example.com/web/**/x]
+shutdown_delay: -1s
+watchdog:
+  warn_threshold: 10s
+log:
+  format: xml
+trace:
+  exporter: jaeger
+`,
+			expected: []string{"workload_socket", "port", "admin_addr", "shutdown_delay", "critical_threshold", "log format", "trace exporter", "approved client rule"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config, _, checkOnly, err := loadConfig([]string{"-check-config", "-config", writeConfigFile(t, tc.file)})
+			if !checkOnly {
+				t.Error("Expected -check-config to be reported")
+			}
+			if err == nil {
+				t.Fatalf("Expected an error, got config %+v", config)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected the error to mention %q, got %v", expected, err)
+				}
+			}
+		})
+	}
+}
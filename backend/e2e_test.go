@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+const (
+	testBackendID  = "spiffe://example.com/backend"
+	testWebID      = "spiffe://example.com/web"
+	testIntruderID = "spiffe://example.com/intruder"
+)
+
+// freePort returns a TCP port that is free on 127.0.0.1.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startBackend boots the real backend against api with env and returns its
+// base URL. It is stopped when the test ends.
+func startBackend(t *testing.T, api *workloadtest.Server, env map[string]string) string {
+	t.Helper()
+	port := freePort(t)
+	t.Setenv("BACKEND_PORT", fmt.Sprint(port))
+	t.Setenv("BACKEND_ADMIN_ADDR", fmt.Sprintf("127.0.0.1:%d", freePort(t)))
+	t.Setenv("BACKEND_SHUTDOWN_DELAY", "0s")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, []string{"-workload-socket", api.Addr(testBackendID)}) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Backend failed: %v", err)
+		}
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "https://" + addr
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Backend exited during startup: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the backend to listen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// mtlsClient calls the backend with the X509-SVID of id. Every request makes
+// a new handshake.
+func mtlsClient(t *testing.T, api *workloadtest.Server, id string) *http.Client {
+	source := api.X509Source(t, id)
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(spiffeid.RequireFromString(testBackendID)))
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID, testIntruderID)
+	url := startBackend(t, api, map[string]string{
+		"BACKEND_APPROVED_CLIENT_SPIFFEID": testWebID,
+		"BACKEND_NAME":                     "Backend (test)",
+	})
+	web := mtlsClient(t, api, testWebID)
+
+	whoami := func() map[string]string {
+		t.Helper()
+		resp, err := web.Get(url + "/whoami")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var data map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return data
+	}
+
+	data := whoami()
+	if data["spiffe_id"] != testBackendID || data["caller_spiffe_id"] != testWebID {
+		t.Errorf("Expected backend %s called by %s, got %v", testBackendID, testWebID, data)
+	}
+
+	// An authenticated workload that is not approved fails the handshake
+	if _, err := mtlsClient(t, api, testIntruderID).Get(url + "/whoami"); err == nil {
+		t.Error("Expected a client that is not approved to be rejected")
+	}
+
+	// After a CA rotation both sides pick up SVIDs from the new root and
+	// still trust each other. Until both have, a handshake may fail.
+	if err := api.RotateCA(); err != nil {
+		t.Fatalf("Failed to rotate CA: %v", err)
+	}
+	newRoot := api.CA().X509Bundle().X509Authorities()[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := web.Get(url + "/whoami")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && resp.TLS.PeerCertificates[0].CheckSignatureFrom(newRoot) == nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the backend to serve an X509-SVID from the rotated CA, last error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeListener completes the TLS handshake of every accepted connection
+// before http.Server sees it, so that its outcome is observed as an error
+// value rather than through the server's error log. Connections whose
+// handshake failed are handed on all the same: http.Server gets the same
+// error from them and logs it as before.
+type handshakeListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+	observe func(*tls.Conn, error)
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newHandshakeListener accepts connections from inner and handshakes them
+// with config, giving each handshake up to timeout.
+func newHandshakeListener(inner net.Listener, config *tls.Config, timeout time.Duration, observe func(*tls.Conn, error)) *handshakeListener {
+	l := &handshakeListener{
+		Listener: inner,
+		config:   config,
+		timeout:  timeout,
+		observe:  observe,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+func (l *handshakeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			// http.Server retries temporary errors, like running out of
+			// file descriptors, and stops on any other
+			if temporary, ok := err.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *handshakeListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	l.observe(tlsConn, err)
+
+	select {
+	case l.conns <- tlsConn:
+	case <-l.closed:
+		tlsConn.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestAuthenticatorJWTSVID(t *testing.T) {
+	issuer := workloadtest.NewJWTIssuer(t, "example.com")
+	bundle, sign := issuer.Bundle(), issuer.Sign
+
+	policies, err := newPolicyStore(Policy{
+		ApprovedClients: []string{"spiffe://example.com/web"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	handler := identity.NewAuthenticator(bundle, "backend", policies.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := identity.CallerFromContext(r.Context())
+		if !ok {
+			t.Error("Expected caller in request context")
+			return
+		}
+		w.Header().Set("X-Caller", caller.ID.String())
+		w.Header().Set("X-Auth-Method", caller.AuthMethod)
+	})))
+
+	valid := time.Now().Add(5 * time.Minute)
+	testCases := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{"valid_token", "Bearer " + sign("spiffe://example.com/web", []string{"backend"}, valid), http.StatusOK},
+		{"wrong_audience", "Bearer " + sign("spiffe://example.com/web", []string{"other"}, valid), http.StatusUnauthorized},
+		{"expired", "Bearer " + sign("spiffe://example.com/web", []string{"backend"}, time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"unapproved_caller", "Bearer " + sign("spiffe://example.com/batch", []string{"backend"}, valid), http.StatusForbidden},
+		{"not_bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"no_credentials", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/whoami", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.expected {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expected, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				if got := w.Header().Get("X-Caller"); got != "spiffe://example.com/web" {
+					t.Errorf("Expected caller spiffe://example.com/web, got %q", got)
+				}
+				if got := w.Header().Get("X-Auth-Method"); got != identity.AuthMethodJWTSVID {
+					t.Errorf("Expected auth method %s, got %q", identity.AuthMethodJWTSVID, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// logRequests logs every request once it has been served, with the caller
+// established further down the chain and the SVID the backend presented.
+func logRequests(source x509svid.Source, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, slot := identity.WithCallerSlot(r)
+		next.ServeHTTP(recorder, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if id := identity.ObservedCallerID(r, slot); !id.IsZero() {
+			attrs = append(attrs, slog.String("peer_spiffe_id", id.String()))
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			attrs = append(attrs, slog.String("peer_serial", r.TLS.PeerCertificates[0].SerialNumber.Text(16)))
+		}
+		if svid, err := source.GetX509SVID(); err == nil {
+			attrs = append(attrs, slog.String("local_spiffe_id", svid.ID.String()))
+		}
+		attrs = append(attrs, telemetry.TraceAttrs(r.Context())...)
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
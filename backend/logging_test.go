@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+func expiringSVID(expiresIn time.Duration) *x509svid.SVID {
+	return &x509svid.SVID{
+		ID:           spiffeid.RequireFromString(testBackendID),
+		Certificates: []*x509.Certificate{{NotAfter: time.Now().Add(expiresIn)}},
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := telemetry.NewLogger(&buf, telemetry.LogConfig{Format: "json", Level: "info"})
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	client := &x509.Certificate{SerialNumber: big.NewInt(42), URIs: []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/web"}}}
+	handler := logRequests(&mockX509Source{svid: expiringSVID(time.Hour)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":             "request",
+		"method":          "GET",
+		"path":            "/whoami",
+		"status":          float64(http.StatusTeapot),
+		"peer_spiffe_id":  testWebID,
+		"peer_serial":     "2a",
+		"local_spiffe_id": testBackendID,
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, record[key])
+		}
+	}
+	if _, ok := record["latency"]; !ok {
+		t.Errorf("Expected a latency, got %v", record)
+	}
+}
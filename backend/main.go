@@ -2,68 +2,96 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/spiffe/go-spiffe/v2/logger"
-	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
-	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/meinsta/workload-id-demo/shared/health"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/meinsta/workload-id-demo/shared/workload"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
 )
 
-type Config struct {
-	SocketPath             string // Legacy field name for compatibility
-	WorkloadSocket         string // New preferred field name
-	ApprovedClientSPIFFEID string
-	Name                   string
-	Infra                  string
-	Port                   string
-}
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 func main() {
-	log.Println("Server is starting...")
-	if err := run(context.Background()); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:]); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+// run serves the backend until ctx is done.
+func run(ctx context.Context, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Parse command line flags
-	workloadSocket := flag.String("workload-socket", "", "Workload API socket address")
-	flag.Parse()
-
-	config := Config{
-		// Legacy compatibility
-		SocketPath:             os.Getenv("BACKEND_SOCKET_PATH"),
-		// New workload socket configuration with multiple sources
-		WorkloadSocket:         getWorkloadSocket(*workloadSocket),
-		ApprovedClientSPIFFEID: os.Getenv("BACKEND_APPROVED_CLIENT_SPIFFEID"),
-		Name:                   os.Getenv("BACKEND_NAME"),
-		Infra:                  os.Getenv("BACKEND_INFRA"),
-		Port:                   os.Getenv("BACKEND_PORT"),
+	config, policies, checkOnly, err := loadConfig(args)
+	if checkOnly {
+		if printErr := configfile.Print(os.Stdout, config); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
 
-	// Use WorkloadSocket preferentially, fallback to legacy SocketPath
-	socketAddr := config.WorkloadSocket
-	if socketAddr == "" {
-		socketAddr = config.SocketPath
+	logger, err := telemetry.NewLogger(os.Stderr, config.Log)
+	if err != nil {
+		return err
 	}
+	slog.SetDefault(logger)
+	slog.Info("Server is starting")
 
-	log.Printf("Using workload API socket: %s", socketAddr)
+	tracerProvider, shutdownTracing, err := telemetry.NewTracerProvider(ctx, os.Stdout, config.Trace, version)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}()
+
+	// The authorization policy was validated with the config, before touching
+	// the Workload API, so a typo fails fast with a clear error
+	policy := policies.Policy()
+	slog.Info("Authorization policy loaded", "version", policy.Version,
+		"approved_clients", strings.Join(policy.ApprovedClients, ","), "routes", len(policy.Routes))
+	if config.PolicyFile != "" {
+		slog.Info("Watching policy file", "path", config.PolicyFile, "interval", config.PolicyReloadInterval)
+		go policies.Watch(ctx, config.PolicyFile, config.PolicyReloadInterval)
+	}
+
+	// A candidate policy only logs where it disagrees with the enforced one
+	shadow := policies.Shadow()
+	if shadow != nil {
+		slog.Info("Shadow policy loaded in log-only mode", "version", shadow.candidate.Policy().Version, "path", config.ShadowPolicyFile)
+		go shadow.candidate.Watch(ctx, config.ShadowPolicyFile, config.PolicyReloadInterval)
+	}
 
-	// Create a `workloadapi.X509Source`
-	source, err := workloadapi.NewX509Source(ctx,
-		workloadapi.WithClientOptions(workloadapi.WithAddr(socketAddr), workloadapi.WithLogger(logger.Std)))
+	// Probes reach the admin listener without a client certificate
+	admin, err := health.Listen(ctx, config.AdminAddr, version, config.WorkloadSocket)
 	if err != nil {
-		return fmt.Errorf("unable to create X509Source: %w", err)
+		return err
+	}
+	defer admin.Close()
+
+	source, err := workload.NewX509Source(ctx, config.WorkloadSocket, config.WorkloadAPIWait, logger)
+	if err != nil {
+		return err
 	}
 	defer source.Close()
 
@@ -73,81 +101,62 @@ func run(ctx context.Context) error {
 	}
 	
 	// Log SVID details on startup - this shows identity without API keys
-	log.Printf("✓ SVID obtained successfully")
-	log.Printf("  SPIFFE ID: %s", svid.ID.String())
-	log.Printf("  Certificate expires: %s", svid.Certificates[0].NotAfter.Format(time.RFC3339))
-	log.Printf("  Time until expiry: %v", time.Until(svid.Certificates[0].NotAfter).Truncate(time.Second))
-	log.Printf("  → No API keys needed - identity is cryptographic")
-
-	clientID := spiffeid.RequireFromString(config.ApprovedClientSPIFFEID)
-
-	tlsConfig := tlsconfig.MTLSServerConfig(source, source, tlsconfig.AuthorizeID(clientID))
-	server := &http.Server{
-		Addr:              fmt.Sprintf(":%s", config.Port),
-		TLSConfig:         tlsConfig,
-		ReadHeaderTimeout: time.Second * 10,
-	}
+	workload.LogSVID("SVID obtained, no API keys needed - identity is cryptographic", svid)
 
-	// Set up a `/whoami` resource handler - shows identity without API keys
-	http.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("WhoAmI request received")
-		
-		// Get current SVID (may have rotated since startup)
-		currentSVID, err := source.GetX509SVID()
+	// Optionally accept JWT-SVIDs for callers whose TLS is terminated by a proxy
+	var jwtBundles jwtbundle.Source
+	if config.JWTAudience != "" {
+		jwtSource, err := workload.NewJWTSource(ctx, config.WorkloadSocket, logger)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get current SVID: %v", err), http.StatusInternalServerError)
-			return
+			return err
 		}
-		
-		notAfter := currentSVID.Certificates[0].NotAfter
-		expiresIn := time.Until(notAfter).Truncate(time.Second)
-		
-		data := map[string]interface{}{
-			"spiffe_id": currentSVID.ID.String(),
-			"not_after":  notAfter.Format(time.RFC3339),
-			"expires_in": expiresIn.String(),
-			"note":       "Authentication via mTLS certificate, not API key",
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(data)
-	})
-
-	// Set up a `/` resource handler
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Request received - Serving Response")
-		// NOTE: No Authorization header validation here - that would be the legacy API key pattern
-		// Instead, mTLS client certificate validation is handled by tlsConfig.AuthorizeID above
-
-		data := make(map[string]string)
-		data["svid"] = svid.ID.String()
-		data["name"] = config.Name
-		data["infra"] = config.Infra
-		data["acceptedSvids"] = config.ApprovedClientSPIFFEID
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(data)
-	})
-
-	log.Printf("Server listening on %s", server.Addr)
-	if err := server.ListenAndServeTLS("", ""); err != nil {
-		return fmt.Errorf("failed to serve: %w", err)
+		defer jwtSource.Close()
+		jwtBundles = jwtSource
+		slog.Info("JWT-SVID bearer authentication enabled", "audience", config.JWTAudience)
 	}
 
-	return nil
-}
+	// The metrics cover the bundles of federated trust domains too
+	bundles, err := workload.WatchX509Bundles(ctx, config.WorkloadSocket, logger)
+	if err != nil {
+		return err
+	}
+	defer bundles.Close()
+	metrics := newMetrics(source, bundles)
+	if shadow != nil {
+		metrics.observeShadow(shadow)
+	}
+
+	// With BACKEND_SVID_EXIT_ON_EXPIRY an expired SVID stops the server
+	monitor := svidwatch.Start(ctx, cancel, source, config.Watchdog, metrics.ObserveRotation)
+
+	server := NewServer(config, source, policies, jwtBundles)
+	server.SetMetrics(metrics)
+	server.SetRotationHistory(monitor.History)
 
-// getWorkloadSocket determines the workload API socket address from multiple sources
-// Priority: 1) flag argument, 2) WORKLOAD_API_SOCKET env, 3) default repo-local socket
-func getWorkloadSocket(flagValue string) string {
-	if flagValue != "" {
-		return flagValue
+	// Every handshake and request decision is appended to the audit log, so
+	// it can be proven which workload accessed what
+	if config.AuditLog != "" {
+		audit, err := openAuditLog(config.AuditLog)
+		if err != nil {
+			return err
+		}
+		defer audit.Close()
+		server.SetAuditLog(audit)
+		policies.SetAuditLog(audit)
+		slog.Info("Audit log enabled", "dest", config.AuditLog)
 	}
-	
-	if envValue := os.Getenv("WORKLOAD_API_SOCKET"); envValue != "" {
-		return envValue
+	server.SetTracerProvider(tracerProvider)
+
+	admin.AddCheck("svid", func(context.Context) error { return monitor.Watchdog.Ready() })
+	admin.AddCheck("trust_bundle", health.BundleCheck(source))
+	drained := admin.Drain(ctx, server, config.ShutdownDelay, config.ShutdownGracePeriod)
+
+	admin.Started()
+	slog.Info("Server listening", "port", config.Port)
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
 	}
-	
-	// Default to repo-local socket for local demo
-	return "unix://testing/.cache/sockets/backend.sock"
+	<-drained
+	slog.Info("Server stopped")
+	return monitor.Err()
 }
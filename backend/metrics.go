@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exports the backend's identity and TLS state to Prometheus, so
+// that alerts can fire before an SVID lapses.
+type Metrics struct {
+	*metrics.Registry
+	handshakes *prometheus.CounterVec
+	requests   *prometheus.CounterVec
+}
+
+// newMetrics creates the metrics of a server using source. SVID expiry and
+// the size of every bundle in bundles are read on every scrape.
+func newMetrics(source SVIDSource, bundles metrics.BundleLister) *Metrics {
+	m := &Metrics{
+		Registry: metrics.NewRegistry(source, bundles),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_handshakes_total",
+			Help: "TLS handshakes with clients by result and failure reason.",
+		}, []string{"result", "reason"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by caller SPIFFE ID, method and status code.",
+		}, []string{"peer_spiffe_id", "method", "code"}),
+	}
+	m.MustRegister(m.handshakes, m.requests)
+	return m
+}
+
+// observeShadow exports the agreement of shadow with the enforced policy.
+func (m *Metrics) observeShadow(shadow *ShadowPolicy) {
+	m.MustRegister(&shadowCollector{shadow: shadow})
+}
+
+// observeHandshake counts a TLS handshake with a client that failed with
+// err, or succeeded if err is nil.
+func (m *Metrics) observeHandshake(_ *tls.Conn, err error) {
+	if err == nil {
+		m.handshakes.WithLabelValues("success", "").Inc()
+		return
+	}
+	m.handshakes.WithLabelValues("failure", metrics.HandshakeErrorReason(err)).Inc()
+}
+
+// instrumentRequests counts requests by the caller established further down
+// the chain by Authenticator.
+func (m *Metrics) instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, slot := identity.WithCallerSlot(r)
+		next.ServeHTTP(recorder, r)
+
+		peer := "none"
+		if id := identity.ObservedCallerID(r, slot); !id.IsZero() {
+			peer = id.String()
+		}
+		m.requests.WithLabelValues(peer, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// shadowCollector reads the shadow policy counters on every scrape.
+type shadowCollector struct {
+	shadow *ShadowPolicy
+}
+
+var shadowDecisionsDesc = prometheus.NewDesc("backend_shadow_policy_decisions_total",
+	"Decisions of the shadow policy by whether they agree with the enforced policy.", []string{"result"}, nil)
+
+func (c *shadowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shadowDecisionsDesc
+}
+
+func (c *shadowCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.shadow.Stats()
+	for result, count := range map[string]uint64{
+		"agree":       stats.Agree,
+		"would_deny":  stats.WouldDeny,
+		"would_allow": stats.WouldAllow,
+	} {
+		ch <- prometheus.MustNewConstMetric(shadowDecisionsDesc, prometheus.CounterValue, float64(count), result)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestMetrics(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID, testIntruderID)
+	policies, err := newPolicyStore(Policy{ApprovedClients: []string{testWebID}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	source := api.X509Source(t, testBackendID)
+	own, err := source.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("example.com"))
+	if err != nil {
+		t.Fatalf("Failed to get bundle: %v", err)
+	}
+	partner := x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("partner.org"), own.X509Authorities())
+	metrics := newMetrics(source, x509bundle.NewSet(own, partner))
+	server := NewServer(Config{}, source, policies, nil)
+	server.SetMetrics(metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svidwatch.Watch(ctx, source, metrics.ObserveRotation)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	web := mtlsClient(t, api, testWebID)
+	resp, err := web.Get(url + "/whoami")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := mtlsClient(t, api, testIntruderID).Get(url + "/whoami"); err == nil {
+		t.Fatal("Expected a client that is not approved to be rejected")
+	}
+
+	api.RotateSVIDs()
+	expected := []string{
+		`http_requests_total{code="200",method="GET",peer_spiffe_id="spiffe://example.com/web"} 1`,
+		`tls_handshakes_total{reason="unauthorized",result="failure"} 1`,
+		`svid_expiry_seconds{spiffe_id="spiffe://example.com/backend"}`,
+		`trust_bundle_certificates{trust_domain="example.com"} 1`,
+		`trust_bundle_certificates{trust_domain="partner.org"} 1`,
+		`svid_rotations_total 1`,
+	}
+
+	// Handshake failures and rotations are recorded asynchronously
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := web.Get(url + "/metrics")
+		if err != nil {
+			t.Fatalf("Failed to scrape metrics: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(data)
+
+		missing := false
+		for _, line := range expected {
+			missing = missing || !strings.Contains(body, line)
+		}
+		if !missing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected metrics %v, got:\n%s", expected, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if successes := testutil.ToFloat64(metrics.handshakes.WithLabelValues("success", "")); successes < 2 {
+		t.Errorf("Expected at least 2 successful handshakes, got %v", successes)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/meinsta/workload-id-demo/shared/authz"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// RoutePolicy maps an http.ServeMux pattern such as "GET /whoami" or "/" to
+// the approved client rules allowed to call it. Requests that match no
+// pattern are denied.
+type RoutePolicy map[string][]string
+
+// parseRoutePolicy decodes a RoutePolicy from its JSON form, e.g.
+//
+//	{"GET /whoami": ["spiffe://example.com/web"], "/": ["spiffe://example.com/*"]}
+func parseRoutePolicy(raw string) (RoutePolicy, error) {
+	var policy RoutePolicy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return nil, fmt.Errorf("invalid route policy JSON: %w", err)
+	}
+	return policy, nil
+}
+
+// routeTable resolves a request to the route policy pattern it falls under.
+type routeTable struct {
+	mux *http.ServeMux
+}
+
+// routeRule is registered on the routeTable mux for every pattern. It is
+// never served, the mux is only used to find the most specific pattern.
+type routeRule struct {
+	pattern string
+	matcher spiffeid.Matcher
+}
+
+func (routeRule) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// compileRoutes validates the route policy and builds its routeTable.
+func compileRoutes(policy RoutePolicy) (*routeTable, error) {
+	if len(policy) == 0 {
+		return nil, errors.New("route policy has no routes")
+	}
+
+	mux := http.NewServeMux()
+	var errs []error
+	for pattern, raw := range policy {
+		matcher, err := authz.Matcher(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %q: %w", pattern, err))
+			continue
+		}
+		if err := handlePattern(mux, pattern, routeRule{pattern: pattern, matcher: matcher}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &routeTable{mux: mux}, nil
+}
+
+// handlePattern registers handler on mux, turning the panic raised for an
+// invalid or conflicting pattern into an error.
+func handlePattern(mux *http.ServeMux, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("route %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, handler)
+	return nil
+}
+
+// authorize checks id against the most specific route matching r. Requests
+// that match no route are denied.
+func (t *routeTable) authorize(r *http.Request, id spiffeid.ID) (string, error) {
+	handler, _ := t.mux.Handler(r)
+	rule, ok := handler.(routeRule)
+	if !ok {
+		return "", errors.New("no route policy allows this request")
+	}
+	if err := rule.matcher(id); err != nil {
+		return rule.pattern, fmt.Errorf("caller is not authorized for route %q: %w", rule.pattern, err)
+	}
+	return rule.pattern, nil
+}
+
+// Decision is the outcome of authorizing a request against a policy.
+type Decision struct {
+	Allowed bool
+	Status  int    // HTTP status to reply with when the request is denied
+	Route   string // Matching route policy pattern, if any
+	Reason  string
+}
+
+func allow(route string) Decision {
+	return Decision{Allowed: true, Route: route}
+}
+
+func deny(status int, route string, err error) Decision {
+	return Decision{Status: status, Route: route, Reason: err.Error()}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/meinsta/workload-id-demo/shared/httpjson"
+)
+
+// requestFrom builds a request that looks like it arrived over mTLS from the
+// given SPIFFE ID.
+func requestFrom(method, target, spiffeID string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if spiffeID != "" {
+		uri, _ := url.Parse(spiffeID)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{uri}}},
+		}
+	}
+	return req
+}
+
+func TestRoutePolicy(t *testing.T) {
+	policy, err := parseRoutePolicy(`{
+		"GET /whoami": ["spiffe://example.com/web", "spiffe://example.com/ops/*"],
+		"GET /{$}": ["spiffe://example.com/*"]
+	}`)
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	store, err := newPolicyStore(Policy{
+		ApprovedClients: []string{"spiffe://example.com/*", "spiffe://other.org/*"},
+		Routes:          policy,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build route authorizer: %v", err)
+	}
+	handler := store.Handler(ok)
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		caller   string
+		expected int
+	}{
+		{"web_whoami", "GET", "/whoami", "spiffe://example.com/web", http.StatusOK},
+		{"ops_whoami", "GET", "/whoami", "spiffe://example.com/ops/oncall", http.StatusOK},
+		{"batch_whoami", "GET", "/whoami", "spiffe://example.com/batch", http.StatusForbidden},
+		{"batch_root", "GET", "/", "spiffe://example.com/batch", http.StatusOK},
+		{"foreign_root", "GET", "/", "spiffe://other.org/web", http.StatusForbidden},
+		{"post_whoami", "POST", "/whoami", "spiffe://example.com/web", http.StatusForbidden},
+		{"unlisted_route", "GET", "/admin", "spiffe://example.com/web", http.StatusForbidden},
+		{"no_client_cert", "GET", "/whoami", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, requestFrom(tc.method, tc.path, tc.caller))
+			if w.Code != tc.expected {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expected, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				return
+			}
+
+			var resp httpjson.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Expected JSON error body, got %q: %v", w.Body.String(), err)
+			}
+			if resp.Path != tc.path || resp.Method != tc.method {
+				t.Errorf("Expected error for %s %s, got %s %s", tc.method, tc.path, resp.Method, resp.Path)
+			}
+			if resp.SPIFFEID != tc.caller || resp.Message == "" {
+				t.Errorf("Expected spiffe_id %q, got %q", tc.caller, resp.SPIFFEID)
+			}
+		})
+	}
+}
+
+func TestCompileRoutesInvalid(t *testing.T) {
+	invalid := []RoutePolicy{
+		{},
+		{"GET /whoami": {"not-an-id"}},
+		{"GET /whoami": {}},
+		{"BAD PATTERN WITH SPACES": {"spiffe://example.com/web"}},
+	}
+	for _, policy := range invalid {
+		if _, err := compileRoutes(policy); err == nil {
+			t.Errorf("Expected policy %v to be rejected", policy)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/authz"
+	"github.com/meinsta/workload-id-demo/shared/httpjson"
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the complete authorization policy of the backend. It is built
+// from the environment or loaded from a YAML/JSON policy file:
+//
+//	version: "2024-06-01"
+//	approved_clients:
+//	  - spiffe://example.com/web
+//	  - spiffe://example.com/batch/*
+//	routes:
+//	  "GET /whoami": ["spiffe://example.com/ops/*"]
+//	  "GET /{$}": ["spiffe://example.com/web", "spiffe://example.com/batch/*"]
+type Policy struct {
+	// Version is a free form label logged whenever the policy changes.
+	Version string `json:"version" yaml:"version"`
+	// ApprovedClients are the rules checked during the TLS handshake.
+	ApprovedClients []string `json:"approved_clients" yaml:"approved_clients"`
+	// Routes optionally narrows access per route, see RoutePolicy.
+	Routes RoutePolicy `json:"routes,omitempty" yaml:"routes,omitempty"`
+}
+
+// compiledPolicy is a validated Policy ready to be used by the server.
+type compiledPolicy struct {
+	policy  Policy
+	matcher spiffeid.Matcher
+	routes  *routeTable // nil when every approved client may call every route
+	digest  string
+}
+
+// decide authorizes an authenticated request. The approved clients are
+// checked again because JWT-SVID callers skip the handshake check, and so
+// that a shadow policy with a narrower list is evaluated faithfully.
+func (p *compiledPolicy) decide(r *http.Request, id spiffeid.ID, idErr error) Decision {
+	if idErr != nil {
+		return deny(http.StatusUnauthorized, "", idErr)
+	}
+	if err := p.matcher(id); err != nil {
+		return deny(http.StatusForbidden, "", err)
+	}
+	if p.routes == nil {
+		return allow("")
+	}
+	route, err := p.routes.authorize(r, id)
+	if err != nil {
+		return deny(http.StatusForbidden, route, err)
+	}
+	return allow(route)
+}
+
+// PolicyStore holds the active policy and lets it be swapped atomically.
+// Handshakes and requests always see a single consistent version; in-flight
+// connections are unaffected by a swap until their next request.
+type PolicyStore struct {
+	current atomic.Pointer[compiledPolicy]
+
+	// shadow optionally evaluates a candidate policy next to this one.
+	shadow *ShadowPolicy
+
+	// audit optionally records every request decision.
+	audit *AuditLog
+
+	// rejected is the digest of the last policy file that failed validation,
+	// so a broken file is only reported once. Only used by Watch.
+	rejected string
+}
+
+// newPolicyStore validates the initial policy and returns a store enforcing
+// it.
+func newPolicyStore(policy Policy) (*PolicyStore, error) {
+	store := &PolicyStore{}
+	compiled, err := store.compile(policy, "")
+	if err != nil {
+		return nil, err
+	}
+	store.current.Store(compiled)
+	return store, nil
+}
+
+func (s *PolicyStore) compile(policy Policy, digest string) (*compiledPolicy, error) {
+	matcher, err := authz.Matcher(policy.ApprovedClients)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes *routeTable
+	if len(policy.Routes) > 0 {
+		if routes, err = compileRoutes(policy.Routes); err != nil {
+			return nil, err
+		}
+	}
+
+	return &compiledPolicy{policy: policy, matcher: matcher, routes: routes, digest: digest}, nil
+}
+
+// Policy returns the active policy.
+func (s *PolicyStore) Policy() Policy {
+	return s.current.Load().policy
+}
+
+// Authorize is a tlsconfig.Authorizer that checks the peer against the
+// approved clients of the active policy.
+func (s *PolicyStore) Authorize(id spiffeid.ID, _ [][]*x509.Certificate) error {
+	current := s.current.Load()
+	err := current.matcher(id)
+	if s.shadow != nil {
+		s.shadow.compareHandshake(current.policy.Version, id, err)
+	}
+	return err
+}
+
+// SetShadow evaluates shadow next to every decision of this store. It must be
+// called before the store starts serving.
+func (s *PolicyStore) SetShadow(shadow *ShadowPolicy) {
+	s.shadow = shadow
+}
+
+// Shadow returns the shadow policy set with SetShadow, or nil.
+func (s *PolicyStore) Shadow() *ShadowPolicy {
+	return s.shadow
+}
+
+// SetAuditLog records every request decision of this store in audit. It must
+// be called before the store starts serving.
+func (s *PolicyStore) SetAuditLog(audit *AuditLog) {
+	s.audit = audit
+}
+
+// Handler applies the route policy of the active version before handing the
+// request to next.
+func (s *PolicyStore) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, next)
+	})
+}
+
+func (s *PolicyStore) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	id, idErr := identity.PeerIDFromRequest(r)
+	current := s.current.Load()
+	decision := current.decide(r, id, idErr)
+	if s.shadow != nil {
+		s.shadow.compareRequest(current.policy.Version, r, id, idErr, decision)
+	}
+	if s.audit != nil {
+		s.audit.Record(authorizationEvent(current.policy.Version, r, decision))
+	}
+	if !decision.Allowed {
+		var caller, code string
+		if idErr == nil {
+			caller = id.String()
+			slog.Info("Request denied", "peer_spiffe_id", caller, "method", r.Method, "path", r.URL.Path, "reason", decision.Reason)
+		}
+		code = "forbidden"
+		if decision.Status == http.StatusUnauthorized {
+			code = "unauthenticated"
+		}
+		httpjson.Error(w, r, decision.Status, code, decision.Reason, caller)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// update validates policy and swaps it in. An invalid policy leaves the
+// active version in place.
+func (s *PolicyStore) update(policy Policy, digest string) error {
+	compiled, err := s.compile(policy, digest)
+	if err != nil {
+		return err
+	}
+	old := s.current.Swap(compiled)
+	slog.Info("Authorization policy changed", "old_version", old.policy.Version, "version", policy.Version,
+		"approved_clients", len(policy.ApprovedClients), "routes", len(policy.Routes))
+	return nil
+}
+
+// loadPolicyFile reads and decodes a policy file along with the digest of
+// its content.
+func loadPolicyFile(path string) (Policy, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Policy{}, "", err
+	}
+	digest := policyDigest(data)
+	policy, err := decodePolicy(data, digest)
+	if err != nil {
+		return Policy{}, digest, fmt.Errorf("unable to parse policy file %s: %w", path, err)
+	}
+	return policy, digest, nil
+}
+
+// decodePolicy decodes a policy document. YAML is a superset of JSON so both
+// formats are accepted. Unknown fields are rejected so typos do not silently
+// change access.
+func decodePolicy(data []byte, digest string) (Policy, error) {
+	var policy Policy
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&policy); err != nil {
+		return Policy{}, err
+	}
+	if policy.Version == "" {
+		policy.Version = "sha256:" + digest[:12]
+	}
+	return policy, nil
+}
+
+func policyDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadPolicyStore builds the initial policy from the policy file if one is
+// configured, or from approved_clients and route_policy otherwise.
+func loadPolicyStore(config Config) (*PolicyStore, error) {
+	if config.PolicyFile != "" {
+		return newPolicyStoreFromFile(config.PolicyFile)
+	}
+
+	policy := Policy{Version: "env", ApprovedClients: config.ApprovedClientSPIFFEIDs, Routes: config.RoutePolicy}
+	store, err := newPolicyStore(policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization policy from approved_clients/route_policy: %w", err)
+	}
+	return store, nil
+}
+
+// newPolicyStoreFromFile loads the policy file and builds a store from it.
+func newPolicyStoreFromFile(path string) (*PolicyStore, error) {
+	policy, digest, err := loadPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &PolicyStore{}
+	compiled, err := store.compile(policy, digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	store.current.Store(compiled)
+	return store, nil
+}
+
+// Watch polls the policy file and swaps in every new valid version until ctx
+// is done. Polling rather than inotify keeps working when Kubernetes updates
+// a mounted ConfigMap by swapping symlinks.
+func (s *PolicyStore) Watch(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.reload(path); err != nil {
+			slog.Warn("Keeping authorization policy", "version", s.Policy().Version, "error", err)
+		}
+	}
+}
+
+// reload swaps in the policy file if its content changed.
+func (s *PolicyStore) reload(path string) error {
+	policy, digest, err := loadPolicyFile(path)
+	if digest != "" && (digest == s.current.Load().digest || digest == s.rejected) {
+		return nil
+	}
+	if err == nil {
+		err = s.update(policy, digest)
+	}
+	if err != nil {
+		s.rejected = digest
+		return err
+	}
+	return nil
+}
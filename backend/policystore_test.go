@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func writePolicyFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write policy file: %v", err)
+	}
+}
+
+func TestPolicyStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicyFile(t, path, `
+version: v1
+approved_clients:
+  - spiffe://example.com/web
+`)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	store, err := newPolicyStoreFromFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if store.Policy().Version != "v1" {
+		t.Fatalf("Expected version v1, got %s", store.Policy().Version)
+	}
+
+	web := spiffeid.RequireFromString("spiffe://example.com/web")
+	batch := spiffeid.RequireFromString("spiffe://example.com/batch")
+	if err := store.Authorize(batch, nil); err == nil {
+		t.Error("Expected batch to be rejected by v1")
+	}
+
+	// JSON is accepted as well, and the new version adds a route policy
+	writePolicyFile(t, path, `{
+		"version": "v2",
+		"approved_clients": ["spiffe://example.com/web", "spiffe://example.com/batch"],
+		"routes": {"GET /whoami": ["spiffe://example.com/web"], "/": ["spiffe://example.com/*"]}
+	}`)
+	if err := store.reload(path); err != nil {
+		t.Fatalf("Failed to reload policy: %v", err)
+	}
+	if store.Policy().Version != "v2" {
+		t.Fatalf("Expected version v2, got %s", store.Policy().Version)
+	}
+	if err := store.Authorize(batch, nil); err != nil {
+		t.Errorf("Expected batch to be approved by v2, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	store.Handler(ok).ServeHTTP(w, requestFrom("GET", "/whoami", batch.String()))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected route policy of v2 to deny batch on /whoami, got %d", w.Code)
+	}
+
+	// An invalid version is rejected and v2 stays active
+	writePolicyFile(t, path, `
+version: v3
+approved_clients: ["not-a-spiffe-id"]
+`)
+	if err := store.reload(path); err == nil {
+		t.Error("Expected invalid policy to be rejected")
+	}
+	if err := store.reload(path); err != nil {
+		t.Errorf("Expected rejected policy to be reported only once, got %v", err)
+	}
+	if store.Policy().Version != "v2" {
+		t.Errorf("Expected v2 to stay active, got %s", store.Policy().Version)
+	}
+
+	writePolicyFile(t, path, `
+version: v4
+approved_clients: [spiffe://example.com/web]
+unknown_field: true
+`)
+	if err := store.reload(path); err == nil {
+		t.Error("Expected unknown fields to be rejected")
+	}
+	if err := store.Authorize(web, nil); err != nil {
+		t.Errorf("Expected web to stay approved, got %v", err)
+	}
+}
+
+func TestPolicyStoreWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicyFile(t, path, "approved_clients: [spiffe://example.com/web]\n")
+
+	store, err := newPolicyStoreFromFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	initial := store.Policy().Version
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, path, 10*time.Millisecond)
+
+	writePolicyFile(t, path, "version: watched\napproved_clients: [spiffe://example.com/*]\n")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Policy().Version != "watched" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Policy was not reloaded, still at %s (initial %s)", store.Policy().Version, initial)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
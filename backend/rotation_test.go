@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestRotationsEndpoint(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	url := startBackend(t, api, map[string]string{"BACKEND_APPROVED_CLIENT_SPIFFEID": testWebID})
+	web := mtlsClient(t, api, testWebID)
+
+	getRotations := func() []svidwatch.Rotation {
+		t.Helper()
+		resp, err := web.Get(url + "/rotations")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Rotations []svidwatch.Rotation `json:"rotations"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode rotations: %v", err)
+		}
+		return body.Rotations
+	}
+
+	rotations := getRotations()
+	if len(rotations) != 1 || rotations[0].SPIFFEID != testBackendID || rotations[0].OldSerial != "" {
+		t.Fatalf("Expected the startup SVID only, got %+v", rotations)
+	}
+
+	api.RotateSVIDs()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rotations) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the rotation to be recorded")
+		}
+		time.Sleep(20 * time.Millisecond)
+		rotations = getRotations()
+	}
+	if rotations[1].OldSerial != rotations[0].Serial || rotations[1].Serial == rotations[0].Serial {
+		t.Errorf("Expected the rotation to replace serial %s, got %+v", rotations[0].Serial, rotations[1])
+	}
+}
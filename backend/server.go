@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SVIDSource provides the backend's X509-SVID and the bundles that verify
+// clients. workloadapi.X509Source implements it.
+type SVIDSource interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// Authorizer decides which callers may reach the backend. PolicyStore
+// implements it.
+type Authorizer interface {
+	// Authorize is consulted during the TLS handshake.
+	Authorize(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error
+	// Handler authorizes every request before handing it to next.
+	Handler(next http.Handler) http.Handler
+	// Policy returns the active policy.
+	Policy() Policy
+}
+
+// Server is the backend's mTLS server. It has its own mux, so it can be
+// started and stopped independently of the process.
+type Server struct {
+	config     Config
+	source     SVIDSource
+	authorizer Authorizer
+	mux        *http.ServeMux
+	http       *http.Server
+
+	// handshakeObservers are told the outcome of every TLS handshake
+	handshakeObservers []func(*tls.Conn, error)
+}
+
+// NewServer builds a server for config. When jwtBundles is set, JWT-SVIDs
+// for config.JWTAudience are accepted as well as client certificates.
+func NewServer(config Config, source SVIDSource, authorizer Authorizer, jwtBundles jwtbundle.Source) *Server {
+	s := &Server{config: config, source: source, authorizer: authorizer, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/whoami", s.handleWhoAmI)
+	s.mux.HandleFunc("/", s.handleIndex)
+
+	s.http = &http.Server{
+		Addr:              fmt.Sprintf(":%s", config.Port),
+		Handler:           logRequests(source, identity.NewAuthenticator(jwtBundles, config.JWTAudience, authorizer.Handler(s.mux))),
+		TLSConfig:         identity.ServerTLSConfig(source, source, authorizer.Authorize, jwtBundles != nil),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	return s
+}
+
+// SetMetrics serves metrics on /metrics and records handshakes and requests
+// in it. Like every route, /metrics is only reachable by authorized callers.
+// It must be called before the server starts serving.
+func (s *Server) SetMetrics(metrics *Metrics) {
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.http.Handler = metrics.instrumentRequests(s.http.Handler)
+	s.handshakeObservers = append(s.handshakeObservers, metrics.observeHandshake)
+}
+
+// SetAuditLog records every TLS handshake of the server in audit. Request
+// decisions are recorded by the Authorizer. It must be called before the
+// server starts serving.
+func (s *Server) SetAuditLog(audit *AuditLog) {
+	s.handshakeObservers = append(s.handshakeObservers, audit.observeHandshake)
+}
+
+// SetTracerProvider starts a span for every request with provider,
+// continuing the trace of the caller. It must be called after the other
+// setters, so that the span covers them, and before the server starts
+// serving.
+func (s *Server) SetTracerProvider(provider trace.TracerProvider) {
+	s.http.Handler = traceRequests(provider, s.source, s.mux, s.http.Handler)
+}
+
+// SetRotationHistory serves history on /rotations, authorized like every
+// other route. It must be called before the server starts serving.
+func (s *Server) SetRotationHistory(history *svidwatch.History) {
+	s.mux.Handle("/rotations", history.Handler())
+}
+
+// Handler returns the authenticated and authorized handlers, without TLS.
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+// ListenAndServe serves on the configured port until Close is called.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves TLS on listener until Close is called. Handshakes are
+// completed before the connection reaches http.Server, so that their outcome
+// can be observed; the clients of the backend speak HTTP/1.1.
+func (s *Server) Serve(listener net.Listener) error {
+	config := s.http.TLSConfig.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	err := s.http.Serve(newHandshakeListener(listener, config, s.http.ReadHeaderTimeout, s.observeHandshake))
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) observeHandshake(conn *tls.Conn, err error) {
+	for _, observe := range s.handshakeObservers {
+		observe(conn, err)
+	}
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish until ctx is done, after which the remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		s.http.Close()
+	}
+	return err
+}
+
+// handleWhoAmI shows the backend's identity without API keys.
+func (s *Server) handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("WhoAmI request received")
+
+	// Get current SVID (may have rotated since startup)
+	currentSVID, err := s.source.GetX509SVID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get current SVID: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	notAfter := currentSVID.Certificates[0].NotAfter
+	expiresIn := time.Until(notAfter).Truncate(time.Second)
+
+	data := map[string]interface{}{
+		"spiffe_id":  currentSVID.ID.String(),
+		"not_after":  notAfter.Format(time.RFC3339),
+		"expires_in": expiresIn.String(),
+		"note":       "Authentication via mTLS certificate, not API key",
+	}
+	if caller, ok := identity.CallerFromContext(r.Context()); ok {
+		data["caller_spiffe_id"] = caller.ID.String()
+		data["caller_auth_method"] = caller.AuthMethod
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// handleIndex describes the backend to the web tier.
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Request received - Serving Response")
+	// NOTE: No Authorization header validation here - that would be the legacy API key pattern
+	// Instead, the caller is authenticated by its X509-SVID (or a JWT-SVID when enabled)
+	// and authorized by the Authorizer
+
+	currentSVID, err := s.source.GetX509SVID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get current SVID: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	data := make(map[string]string)
+	data["svid"] = currentSVID.ID.String()
+	data["name"] = s.config.Name
+	data["infra"] = s.config.Infra
+	data["acceptedSvids"] = strings.Join(s.authorizer.Policy().ApprovedClients, ",")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
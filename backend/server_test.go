@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestServerServe(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	policies, err := newPolicyStore(Policy{ApprovedClients: []string{testWebID}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	server := NewServer(Config{Name: "Backend (test)", Infra: "test"}, api.X509Source(t, testBackendID), policies, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+
+	resp, err := mtlsClient(t, api, testWebID).Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var data map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := map[string]string{"svid": testBackendID, "name": "Backend (test)", "infra": "test", "acceptedSvids": testWebID}
+	for key, value := range expected {
+		if data[key] != value {
+			t.Errorf("Expected %s %q, got %q", key, value, data[key])
+		}
+	}
+
+	if err := server.Close(); err != nil {
+		t.Errorf("Failed to close server: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected Serve to return nil after Close, got %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	policies, err := newPolicyStore(Policy{ApprovedClients: []string{testWebID}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		grace    time.Duration
+		expected error // Returned by Shutdown
+	}{
+		{"drained", 5 * time.Second, nil},
+		{"grace_period_over", 50 * time.Millisecond, context.DeadlineExceeded},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(Config{}, api.X509Source(t, testBackendID), policies, nil)
+			started, release := make(chan struct{}), make(chan struct{})
+			server.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			})
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			go server.Serve(listener)
+			url := "https://" + listener.Addr().String()
+
+			client := mtlsClient(t, api, testWebID)
+			inFlight := make(chan error, 1)
+			go func() {
+				resp, err := client.Get(url + "/slow")
+				if err == nil {
+					resp.Body.Close()
+				}
+				inFlight <- err
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.grace)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- server.Shutdown(ctx) }()
+
+			// New connections are refused while the request in flight drains
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					break
+				}
+				conn.Close()
+				if time.Now().After(deadline) {
+					t.Fatal("Timed out waiting for the listener to close")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if tc.expected == nil {
+				close(release)
+				if err := <-inFlight; err != nil {
+					t.Errorf("Expected the request in flight to complete, got %v", err)
+				}
+			} else if err := <-inFlight; err == nil {
+				t.Error("Expected the request in flight to be cut off after the grace period")
+			}
+			if err := <-shutdown; !errors.Is(err, tc.expected) {
+				t.Errorf("Expected Shutdown to return %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
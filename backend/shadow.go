@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ShadowPolicy evaluates a candidate policy next to the enforced one without
+// affecting any decision, and reports every handshake or request where the
+// two disagree. Running a tightened policy in shadow mode for a while shows
+// which callers it would break before it is enforced.
+type ShadowPolicy struct {
+	candidate *PolicyStore
+
+	evaluated  atomic.Uint64
+	agree      atomic.Uint64
+	wouldDeny  atomic.Uint64
+	wouldAllow atomic.Uint64
+}
+
+// ShadowStats counts shadow evaluations since startup.
+type ShadowStats struct {
+	Evaluated  uint64 `json:"evaluated"`
+	Agree      uint64 `json:"agree"`       // Decided the same by both policies
+	WouldDeny  uint64 `json:"would_deny"`  // Allowed by the enforced policy, denied by the candidate
+	WouldAllow uint64 `json:"would_allow"` // Denied by the enforced policy, allowed by the candidate
+}
+
+func newShadowPolicy(candidate *PolicyStore) *ShadowPolicy {
+	return &ShadowPolicy{candidate: candidate}
+}
+
+// Stats returns the counters. Each is read on its own, so they may not add
+// up exactly while decisions are being compared.
+func (s *ShadowPolicy) Stats() ShadowStats {
+	return ShadowStats{
+		Evaluated:  s.evaluated.Load(),
+		Agree:      s.agree.Load(),
+		WouldDeny:  s.wouldDeny.Load(),
+		WouldAllow: s.wouldAllow.Load(),
+	}
+}
+
+// compareHandshake evaluates the candidate approved clients for a peer the
+// enforced policy has just authorized or rejected.
+func (s *ShadowPolicy) compareHandshake(enforcedVersion string, id spiffeid.ID, enforcedErr error) {
+	enforced := allow("")
+	if enforcedErr != nil {
+		enforced = deny(0, "", enforcedErr)
+	}
+	candidate := allow("")
+	if err := s.candidate.current.Load().matcher(id); err != nil {
+		candidate = deny(0, "", err)
+	}
+	s.compare(enforcedVersion, fmt.Sprintf("handshake from %s", id), enforced, candidate)
+}
+
+// compareRequest evaluates the candidate policy for a request the enforced
+// policy has already decided on.
+func (s *ShadowPolicy) compareRequest(enforcedVersion string, r *http.Request, id spiffeid.ID, idErr error, enforced Decision) {
+	candidate := s.candidate.current.Load().decide(r, id, idErr)
+
+	caller := "unauthenticated caller"
+	if idErr == nil {
+		caller = id.String()
+	}
+	s.compare(enforcedVersion, fmt.Sprintf("%s %s from %s", r.Method, r.URL.Path, caller), enforced, candidate)
+}
+
+func (s *ShadowPolicy) compare(enforcedVersion, subject string, enforced, candidate Decision) {
+	s.evaluated.Add(1)
+	if enforced.Allowed == candidate.Allowed {
+		s.agree.Add(1)
+		return
+	}
+
+	candidateVersion := s.candidate.Policy().Version
+	if enforced.Allowed {
+		s.wouldDeny.Add(1)
+		slog.Warn("Shadow policy would DENY", "subject", subject, "shadow_version", candidateVersion,
+			"enforced_version", enforcedVersion, "reason", candidate.Reason)
+		return
+	}
+	s.wouldAllow.Add(1)
+	slog.Warn("Shadow policy would ALLOW", "subject", subject, "shadow_version", candidateVersion,
+		"enforced_version", enforcedVersion, "reason", enforced.Reason)
+}
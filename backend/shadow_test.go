@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestShadowPolicy(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	enforced, err := newPolicyStore(Policy{
+		Version:         "enforced",
+		ApprovedClients: []string{"spiffe://example.com/*"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build enforced policy: %v", err)
+	}
+	candidate, err := newPolicyStore(Policy{
+		Version:         "candidate",
+		ApprovedClients: []string{"spiffe://example.com/web", "spiffe://partner.org/web"},
+		Routes:          RoutePolicy{"GET /{$}": {"spiffe://example.com/web"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build candidate policy: %v", err)
+	}
+	shadow := newShadowPolicy(candidate)
+	enforced.SetShadow(shadow)
+
+	// Handshakes: batch is allowed today but not by the candidate, partner
+	// is the other way around
+	if err := enforced.Authorize(spiffeid.RequireFromString("spiffe://example.com/batch"), nil); err != nil {
+		t.Errorf("Shadow policy must not change the enforced decision, got %v", err)
+	}
+	if err := enforced.Authorize(spiffeid.RequireFromString("spiffe://partner.org/web"), nil); err == nil {
+		t.Error("Shadow policy must not change the enforced decision")
+	}
+	if err := enforced.Authorize(spiffeid.RequireFromString("spiffe://example.com/web"), nil); err != nil {
+		t.Errorf("Expected web to be authorized, got %v", err)
+	}
+
+	// Requests: web may call / but not /whoami under the candidate
+	for _, path := range []string{"/", "/whoami"} {
+		w := httptest.NewRecorder()
+		enforced.Handler(ok).ServeHTTP(w, requestFrom("GET", path, "spiffe://example.com/web"))
+		if w.Code != http.StatusOK {
+			t.Errorf("Shadow policy must not change the enforced decision for %s, got %d", path, w.Code)
+		}
+	}
+
+	expected := ShadowStats{Evaluated: 5, Agree: 2, WouldDeny: 2, WouldAllow: 1}
+	if stats := shadow.Stats(); stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&shadowCollector{shadow: shadow})
+	exported := `
+# HELP backend_shadow_policy_decisions_total Decisions of the shadow policy by whether they agree with the enforced policy.
+# TYPE backend_shadow_policy_decisions_total counter
+backend_shadow_policy_decisions_total{result="agree"} 2
+backend_shadow_policy_decisions_total{result="would_allow"} 1
+backend_shadow_policy_decisions_total{result="would_deny"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(exported)); err != nil {
+		t.Errorf("Unexpected shadow metrics: %v", err)
+	}
+}
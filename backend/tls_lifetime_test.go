@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 )
@@ -67,8 +68,8 @@ func TestTLSLifetimeLogging(t *testing.T) {
 					expectedLifetime, remainingLifetime)
 			}
 			
-			// Test warning logic
-			shouldWarn := remainingLifetime < 2*time.Minute
+			// Test warning logic of the watchdog
+			shouldWarn := svidwatch.NewWatchdog(&mockX509Source{svid: svid}, svidwatch.DefaultWatchdogConfig()).Check() != svidwatch.LevelOK
 			if shouldWarn != tc.expectWarn {
 				t.Errorf("Expected warn=%v for %v remaining, got warn=%v", 
 					tc.expectWarn, remainingLifetime, shouldWarn)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests starts a span for every request, named after the pattern of
+// routes it matches and continuing the trace of the caller, and annotates it
+// with the authenticated caller, the backend's own SPIFFE ID and the TLS
+// connection once the request has been served.
+func traceRequests(provider trace.TracerProvider, source x509svid.Source, routes telemetry.Router, next http.Handler) http.Handler {
+	annotated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, slot := identity.WithCallerSlot(r)
+		next.ServeHTTP(w, r)
+
+		span := trace.SpanFromContext(r.Context())
+		if id := identity.ObservedCallerID(r, slot); !id.IsZero() {
+			span.SetAttributes(attribute.String("spiffe.peer_id", id.String()))
+		}
+		if slot.AuthMethod != "" {
+			span.SetAttributes(attribute.String("spiffe.auth_method", slot.AuthMethod))
+		}
+		if svid, err := source.GetX509SVID(); err == nil {
+			span.SetAttributes(attribute.String("spiffe.local_id", svid.ID.String()))
+		}
+		span.SetAttributes(telemetry.TLSAttributes(r.TLS)...)
+	})
+	return otelhttp.NewHandler(annotated, "backend",
+		otelhttp.WithTracerProvider(provider),
+		otelhttp.WithPropagators(telemetry.Propagator),
+		otelhttp.WithSpanNameFormatter(telemetry.RouteSpanName(routes)))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/meinsta/workload-id-demo/shared/identity"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceRequests(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	policies, err := newPolicyStore(Policy{ApprovedClients: []string{testWebID}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	source := api.X509Source(t, testBackendID)
+	recorder := tracetest.NewSpanRecorder()
+	server := NewServer(Config{}, source, policies, nil)
+	server.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest(http.MethodGet, "https://"+listener.Addr().String()+"/whoami", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	resp, err := mtlsClient(t, api, testWebID).Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /whoami" {
+		t.Errorf("Expected span GET /whoami, got %s", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != traceID || span.Parent().SpanID().String() != parentID {
+		t.Errorf("Expected the span to continue trace %s, got %s", traceID, span.SpanContext().TraceID())
+	}
+	attrs := map[attribute.Key]string{}
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value.Emit()
+	}
+	expected := map[attribute.Key]string{
+		"spiffe.peer_id":       testWebID,
+		"spiffe.local_id":      testBackendID,
+		"spiffe.auth_method":   identity.AuthMethodX509SVID,
+		"tls.protocol.version": "TLS 1.3",
+	}
+	for key, value := range expected {
+		if attrs[key] != value {
+			t.Errorf("Expected %s %s, got %s", key, value, attrs[key])
+		}
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"net/http"
@@ -11,12 +9,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
-	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
-// mockX509Source implements workloadapi.X509Source for testing
+// mockX509Source is an SVIDSource with a fixed SVID
 type mockX509Source struct {
 	svid *x509svid.SVID
 }
@@ -25,26 +23,10 @@ func (m *mockX509Source) GetX509SVID() (*x509svid.SVID, error) {
 	return m.svid, nil
 }
 
-func (m *mockX509Source) GetX509BundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*x509.Bundle, error) {
+func (m *mockX509Source) GetX509BundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
 	return nil, nil
 }
 
-func (m *mockX509Source) GetX509Context() (*workloadapi.X509Context, error) {
-	return nil, nil
-}
-
-func (m *mockX509Source) WatchX509Context(ctx context.Context) <-chan *workloadapi.X509Context {
-	return nil
-}
-
-func (m *mockX509Source) Close() error {
-	return nil
-}
-
-func (m *mockX509Source) Updated() <-chan struct{} {
-	return nil
-}
-
 func TestWhoAmIEndpoint(t *testing.T) {
 	// Create a mock SVID that expires in 5 minutes
 	spiffeID := spiffeid.RequireFromString("spiffe://example.com/test")
@@ -63,8 +45,12 @@ func TestWhoAmIEndpoint(t *testing.T) {
 	
 	mockSource := &mockX509Source{svid: mockSVID}
 	
-	// Create handler with mock source
-	handler := createWhoAmIHandler(mockSource)
+	// Create the real handler with mock source
+	policies, err := newPolicyStore(Policy{ApprovedClients: []string{"spiffe://example.com/web"}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+	handler := NewServer(Config{}, mockSource, policies, nil).handleWhoAmI
 	
 	// Create test request
 	req := httptest.NewRequest("GET", "/whoami", nil)
@@ -108,31 +94,6 @@ func TestWhoAmIEndpoint(t *testing.T) {
 	}
 }
 
-// createWhoAmIHandler creates the /whoami handler for testing
-func createWhoAmIHandler(source workloadapi.X509Source) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get current SVID (may have rotated since startup)
-		currentSVID, err := source.GetX509SVID()
-		if err != nil {
-			http.Error(w, "Failed to get current SVID", http.StatusInternalServerError)
-			return
-		}
-		
-		notAfter := currentSVID.Certificates[0].NotAfter
-		expiresIn := time.Until(notAfter).Truncate(time.Second)
-		
-		data := map[string]interface{}{
-			"spiffe_id": currentSVID.ID.String(),
-			"not_after":  notAfter.Format(time.RFC3339),
-			"expires_in": expiresIn.String(),
-			"note":       "Authentication via mTLS certificate, not API key",
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(data)
-	}
-}
-
 func TestNoAPIKeyPattern(t *testing.T) {
 	// This test verifies that we don't accidentally use API key patterns
 	
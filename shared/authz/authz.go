@@ -0,0 +1,291 @@
+// Package authz parses and compiles the rules that decide which SPIFFE IDs a
+// service accepts as its peers, such as the approved clients of the backend.
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// Rule describes a set of SPIFFE IDs that are allowed to connect.
+// All non-empty fields must match; an exact ID cannot be combined with the
+// other fields.
+type Rule struct {
+	// ID matches exactly one SPIFFE ID.
+	ID string `json:"id,omitempty"`
+	// TrustDomain matches any ID in the given trust domain.
+	TrustDomain string `json:"trust_domain,omitempty"`
+	// PathPrefix matches IDs whose path is the prefix or lies below it. It is
+	// matched on path segment boundaries, so "/apps/w2w" does not match
+	// "/apps/w2w-demo".
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// PathRegex matches IDs whose whole path matches the expression.
+	PathRegex string `json:"path_regex,omitempty"`
+}
+
+// String renders the rule in the same syntax accepted by ParseRule where
+// possible, so it can be logged and echoed back to callers.
+func (r Rule) String() string {
+	switch {
+	case r.ID != "":
+		return r.ID
+	case r.PathRegex == "" && r.TrustDomain != "" && (r.PathPrefix == "" || strings.HasSuffix(r.PathPrefix, "/")):
+		return "spiffe://" + r.TrustDomain + strings.TrimSuffix(r.PathPrefix, "/") + "/*"
+	case r.PathRegex != "" && r.TrustDomain == "" && r.PathPrefix == "":
+		return "regex:" + r.PathRegex
+	case r.PathRegex != "" && r.TrustDomain != "" && r.PathPrefix == "" && strings.HasPrefix(r.PathRegex, "/"):
+		return "regex:spiffe://" + r.TrustDomain + r.PathRegex
+	}
+
+	var parts []string
+	if r.TrustDomain != "" {
+		parts = append(parts, "trust_domain="+r.TrustDomain)
+	}
+	if r.PathPrefix != "" {
+		parts = append(parts, "path_prefix="+r.PathPrefix)
+	}
+	if r.PathRegex != "" {
+		parts = append(parts, "path_regex="+r.PathRegex)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseRule parses the compact rule syntax used in environment variables:
+//
+//	spiffe://example.com/web                   exact SPIFFE ID
+//	spiffe://example.com/*                     any ID in the trust domain
+//	spiffe://example.com/apps/w2w-demo/*       any ID under the path prefix
+//	regex:spiffe://example.com/apps/[^/]+/web  path regex in the trust domain
+//	regex:^/apps/[^/]+/web$                    path regex in every trust domain
+//
+// A regex without a trust domain matches IDs of every trust domain the
+// service trusts, federated ones included.
+func ParseRule(value string) (Rule, error) {
+	if expr, ok := strings.CutPrefix(value, "regex:"); ok {
+		rest, ok := strings.CutPrefix(expr, "spiffe://")
+		if !ok {
+			return Rule{PathRegex: expr}, nil
+		}
+		// The path regex starts at the first slash after the trust domain
+		name, path, ok := strings.Cut(rest, "/")
+		if !ok {
+			return Rule{}, fmt.Errorf("regex rule %q has no path after the trust domain", value)
+		}
+		td, err := spiffeid.TrustDomainFromString(name)
+		if err != nil {
+			return Rule{}, err
+		}
+		return Rule{TrustDomain: td.String(), PathRegex: "/" + path}, nil
+	}
+
+	if prefix, ok := strings.CutSuffix(value, "/*"); ok {
+		id, err := spiffeid.FromString(prefix)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule := Rule{TrustDomain: id.TrustDomain().String()}
+		if id.Path() != "" {
+			rule.PathPrefix = id.Path() + "/"
+		}
+		return rule, nil
+	}
+
+	if _, err := spiffeid.FromString(value); err != nil {
+		return Rule{}, err
+	}
+	return Rule{ID: value}, nil
+}
+
+// ParseRules parses every configured rule and reports all malformed entries
+// at once instead of panicking on the first.
+func ParseRules(raw []string) ([]Rule, error) {
+	var (
+		rules []Rule
+		errs  []error
+	)
+	for _, value := range raw {
+		rule, err := ParseRule(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid approved client rule %q: %w", value, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
+
+// compile validates the rule and turns it into a spiffeid.Matcher.
+func (r Rule) compile() (spiffeid.Matcher, error) {
+	if r.ID != "" {
+		if r.TrustDomain != "" || r.PathPrefix != "" || r.PathRegex != "" {
+			return nil, errors.New("id cannot be combined with other fields")
+		}
+		id, err := spiffeid.FromString(r.ID)
+		if err != nil {
+			return nil, err
+		}
+		return spiffeid.MatchID(id), nil
+	}
+
+	if r.TrustDomain == "" && r.PathPrefix == "" && r.PathRegex == "" {
+		return nil, errors.New("rule has no conditions")
+	}
+
+	var (
+		td       spiffeid.TrustDomain
+		pathExpr *regexp.Regexp
+		err      error
+	)
+	if r.TrustDomain != "" {
+		if td, err = spiffeid.TrustDomainFromString(r.TrustDomain); err != nil {
+			return nil, err
+		}
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return nil, fmt.Errorf("path prefix %q must start with /", r.PathPrefix)
+	}
+	if r.PathRegex != "" {
+		if pathExpr, err = regexp.Compile("^(?:" + r.PathRegex + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid path regex: %w", err)
+		}
+	}
+
+	return func(actual spiffeid.ID) error {
+		if !td.IsZero() && !actual.MemberOf(td) {
+			return fmt.Errorf("unexpected trust domain %q", actual.TrustDomain())
+		}
+		if r.PathPrefix != "" && !hasPathPrefix(actual.Path(), r.PathPrefix) {
+			return fmt.Errorf("path %q is not under %q", actual.Path(), r.PathPrefix)
+		}
+		if pathExpr != nil && !pathExpr.MatchString(actual.Path()) {
+			return fmt.Errorf("path %q does not match %q", actual.Path(), r.PathRegex)
+		}
+		return nil
+	}, nil
+}
+
+// hasPathPrefix reports whether path equals prefix or continues it with a new
+// path segment. A prefix ending in "/" already marks the segment boundary.
+func hasPathPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// CompileRules combines the rules into a single matcher that accepts an ID
+// when any rule matches it.
+func CompileRules(rules []Rule) (spiffeid.Matcher, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no approved client rules configured")
+	}
+
+	var errs []error
+	matchers := make([]spiffeid.Matcher, 0, len(rules))
+	for i, rule := range rules {
+		matcher, err := rule.compile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d (%s): %w", i, rule, err))
+			continue
+		}
+		matchers = append(matchers, matcher)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return func(actual spiffeid.ID) error {
+		for _, matcher := range matchers {
+			if matcher(actual) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("unexpected ID %q: no approved client rule matched", actual)
+	}, nil
+}
+
+// Matcher parses raw in the compact rule syntax and combines the rules into
+// a single matcher.
+func Matcher(raw []string) (spiffeid.Matcher, error) {
+	rules, err := ParseRules(raw)
+	if err != nil {
+		return nil, err
+	}
+	return CompileRules(rules)
+}
+
+// Authorizer is like Matcher, for authorizing the peer of a TLS connection.
+func Authorizer(raw ...string) (tlsconfig.Authorizer, error) {
+	matcher, err := Matcher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return tlsconfig.AdaptMatcher(matcher), nil
+}
+
+// SplitList splits a comma separated environment value into its trimmed,
+// non-empty elements. Commas inside brackets, braces or parentheses, or
+// escaped with a backslash, do not separate elements, so a regex: rule with a
+// quantifier such as {1,3} stays in one piece. Inside a character class
+// brackets, braces and parentheses are literals, as they are to the regex.
+func SplitList(value string) []string {
+	var (
+		out     []string
+		depth   int
+		start   int
+		inClass bool
+	)
+	add := func(part string) {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		if inClass {
+			switch value[i] {
+			case '\\':
+				i++
+			case ']':
+				inClass = false
+				depth--
+			}
+			continue
+		}
+		switch value[i] {
+		case '\\':
+			i++
+		case '[':
+			// A ] right after the opening bracket, or its negation, is a
+			// literal member of the class
+			inClass = true
+			depth++
+			if strings.HasPrefix(value[i+1:], "^") {
+				i++
+			}
+			if strings.HasPrefix(value[i+1:], "]") {
+				i++
+			}
+		case '(', '{':
+			depth++
+		case ')', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				add(value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(value[start:])
+	return out
+}
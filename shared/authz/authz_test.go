@@ -0,0 +1,170 @@
+package authz
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" spiffe://example.com/web, ,spiffe://example.com/batch ,")
+	want := []string{"spiffe://example.com/web", "spiffe://example.com/batch"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Entry %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSplitListKeepsRegexIntact(t *testing.T) {
+	got := SplitList(`spiffe://example.com/web,regex:^/ns/[a-z,]+/sa/w{1,3}$,regex:^/(a|b)\,c$`)
+	want := []string{"spiffe://example.com/web", "regex:^/ns/[a-z,]+/sa/w{1,3}$", `regex:^/(a|b)\,c$`}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %q", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Entry %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if _, err := Matcher(got); err != nil {
+		t.Errorf("Expected split rules to compile, got %v", err)
+	}
+
+	// Parentheses and brackets are literals inside a character class
+	got = SplitList(`regex:^/a[(]$,regex:^/b[])]$,regex:^/c[^]{]$,spiffe://example.com/web`)
+	want = []string{"regex:^/a[(]$", "regex:^/b[])]$", "regex:^/c[^]{]$", "spiffe://example.com/web"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d entries, got %d: %q", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Entry %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if _, err := Matcher(got); err != nil {
+		t.Errorf("Expected split rules to compile, got %v", err)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected Rule
+	}{
+		{"spiffe://example.com/web", Rule{ID: "spiffe://example.com/web"}},
+		{"spiffe://example.com/*", Rule{TrustDomain: "example.com"}},
+		{"spiffe://example.com/apps/w2w-demo/*", Rule{TrustDomain: "example.com", PathPrefix: "/apps/w2w-demo/"}},
+		{"regex:/apps/[^/]+/web", Rule{PathRegex: "/apps/[^/]+/web"}},
+		{"regex:spiffe://example.com/apps/[^/]+/web", Rule{TrustDomain: "example.com", PathRegex: "/apps/[^/]+/web"}},
+	}
+
+	for _, tc := range testCases {
+		rule, err := ParseRule(tc.input)
+		if err != nil {
+			t.Errorf("ParseRule(%q) returned error: %v", tc.input, err)
+			continue
+		}
+		if rule != tc.expected {
+			t.Errorf("ParseRule(%q) = %+v, expected %+v", tc.input, rule, tc.expected)
+		}
+		if rule.String() != tc.input {
+			t.Errorf("Rule round-trip failed: %q != %q", rule.String(), tc.input)
+		}
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	matcher, err := CompileRules([]Rule{
+		{ID: "spiffe://example.com/web"},
+		{TrustDomain: "partner.org"},
+		{TrustDomain: "mwidemo.cloud.gravitational.io", PathPrefix: "/apps/w2w-demo/"},
+		{PathRegex: "/ns/team-x/sa/[^/]+"},
+		{TrustDomain: "td.example", PathPrefix: "/apps/w2w"},
+		{TrustDomain: "example.com", PathRegex: "/jobs/[0-9]+"},
+	})
+	if err != nil {
+		t.Fatalf("Expected rules to compile, got %v", err)
+	}
+
+	testCases := []struct {
+		id      string
+		allowed bool
+	}{
+		{"spiffe://example.com/web", true},
+		{"spiffe://example.com/web2", false},
+		{"spiffe://partner.org/anything/at/all", true},
+		{"spiffe://mwidemo.cloud.gravitational.io/apps/w2w-demo/web", true},
+		{"spiffe://mwidemo.cloud.gravitational.io/apps/other/web", false},
+		{"spiffe://example.com/apps/w2w-demo/web", false},
+		{"spiffe://cluster.local/ns/team-x/sa/batch", true},
+		{"spiffe://cluster.local/ns/team-x/sa/batch/extra", false},
+		{"spiffe://cluster.local/ns/team-y/sa/batch", false},
+		{"spiffe://td.example/apps/w2w", true},
+		{"spiffe://td.example/apps/w2w/web", true},
+		{"spiffe://td.example/apps/w2w-demo", false},
+		{"spiffe://td.example/apps/w2w-demo/web", false},
+		{"spiffe://example.com/jobs/42", true},
+		{"spiffe://partner.example/jobs/42", false},
+	}
+
+	for _, tc := range testCases {
+		err := matcher(spiffeid.RequireFromString(tc.id))
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s: expected allowed=%v, got err=%v", tc.id, tc.allowed, err)
+		}
+	}
+}
+
+func TestCompileRulesInvalid(t *testing.T) {
+	invalid := []Rule{
+		{},
+		{ID: "spiffe://example.com/web", TrustDomain: "example.com"},
+		{TrustDomain: "Not A Domain"},
+		{PathPrefix: "apps/"},
+		{PathRegex: "("},
+	}
+
+	for _, rule := range invalid {
+		if _, err := CompileRules([]Rule{rule}); err == nil {
+			t.Errorf("Expected rule %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	_, err := ParseRules([]string{"not-a-spiffe-id", "spiffe://example.com/web", "spiffe://EXAMPLE/bad", "regex:spiffe://example.com", "regex:spiffe://EXAMPLE/web"})
+	if err == nil {
+		t.Fatal("Expected error for malformed IDs")
+	}
+	for _, bad := range []string{"not-a-spiffe-id", "spiffe://EXAMPLE/bad", "regex:spiffe://example.com", "regex:spiffe://EXAMPLE/web"} {
+		if !strings.Contains(err.Error(), bad) {
+			t.Errorf("Expected error to mention %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	authorize, err := Authorizer("spiffe://example.com/backend", "spiffe://example.com/backends/*")
+	if err != nil {
+		t.Fatalf("Expected rules to compile, got %v", err)
+	}
+	for id, allowed := range map[string]bool{
+		"spiffe://example.com/backend":          true,
+		"spiffe://example.com/backends/billing": true,
+		"spiffe://example.com/web":              false,
+	} {
+		if err := authorize(spiffeid.RequireFromString(id), [][]*x509.Certificate{}); (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%v, got err=%v", id, allowed, err)
+		}
+	}
+
+	if _, err := Authorizer(); err == nil {
+		t.Error("Expected an authorizer without rules to be rejected")
+	}
+}
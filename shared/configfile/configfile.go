@@ -0,0 +1,65 @@
+// Package configfile reads and prints the versioned YAML config files of the
+// services and validates the settings they have in common.
+package configfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load decodes the config file at path over config, a pointer to the config
+// struct already holding the defaults. Unknown fields are rejected so that a
+// typo does not silently fall back to a default. version points at the
+// version field of config, which the file must set to supported.
+func Load(path string, config interface{}, version *int, supported int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+	*version = 0
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	if *version != supported {
+		return fmt.Errorf("config file %s has version %d, this build only supports version %d", path, *version, supported)
+	}
+	return nil
+}
+
+// Print writes config to w in the format of the config file.
+func Print(w io.Writer, config interface{}) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(config); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// ValidatePort checks that port is a TCP port number.
+func ValidatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q: must be a number from 1 to 65535", port)
+	}
+	return nil
+}
+
+// ValidateListenAddr checks that addr is a host:port to listen on, where the
+// host may be empty.
+func ValidateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return ValidatePort(port)
+}
@@ -0,0 +1,67 @@
+package configfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Version int    `yaml:"version"`
+	Name    string `yaml:"name"`
+	Port    string `yaml:"port"`
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return path
+	}
+
+	config := testConfig{Version: 1, Name: "default", Port: "8443"}
+	if err := Load(write("valid.yaml", "version: 1\nname: file\n"), &config, &config.Version, 1); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config != (testConfig{Version: 1, Name: "file", Port: "8443"}) {
+		t.Errorf("Expected the file to override the defaults it sets, got %+v", config)
+	}
+
+	var printed bytes.Buffer
+	if err := Print(&printed, config); err != nil {
+		t.Fatalf("Failed to print config: %v", err)
+	}
+	reloaded := testConfig{}
+	if err := Load(write("printed.yaml", printed.String()), &reloaded, &reloaded.Version, 1); err != nil || reloaded != config {
+		t.Errorf("Expected the printed config to load back as %+v, got %+v (%v)", config, reloaded, err)
+	}
+
+	for name, content := range map[string]string{
+		"unknown_field":   "version: 1\nnmae: typo\n",
+		"missing_version": "name: file\n",
+		"future_version":  "version: 2\n",
+	} {
+		config := testConfig{Version: 1}
+		if err := Load(write(name+".yaml", content), &config, &config.Version, 1); err == nil {
+			t.Errorf("%s: expected the config file to be rejected", name)
+		}
+	}
+}
+
+func TestValidateListenAddr(t *testing.T) {
+	for _, addr := range []string{":9091", "127.0.0.1:8080"} {
+		if err := ValidateListenAddr(addr); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"9091", ":0", ":http", "localhost:70000"} {
+		if err := ValidateListenAddr(addr); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("Expected %q to be rejected, got %v", addr, err)
+		}
+	}
+}
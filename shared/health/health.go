@@ -0,0 +1,184 @@
+// Package health serves the liveness, readiness and build information of a
+// service, and provides the readiness checks the services share.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/httpjson"
+	"github.com/meinsta/workload-id-demo/shared/workload"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// readinessTimeout bounds each readiness check, so that a hanging dependency
+// fails the probe instead of timing it out.
+const readinessTimeout = 2 * time.Second
+
+// Check reports whether one dependency is ready.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Admin serves liveness, readiness and build information over plain HTTP, on
+// a listener separate from the mTLS port, so that probes need no client
+// certificate.
+type Admin struct {
+	version string
+
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+// New creates an admin handler without readiness checks. version is reported
+// on /buildinfo.
+func New(version string) *Admin {
+	return &Admin{version: version}
+}
+
+// AddCheck adds a readiness check. /readyz fails while any check fails.
+func (a *Admin) AddCheck(name string, check Check) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checks = append(a.checks, namedCheck{name: name, check: check})
+}
+
+// Handler serves /healthz, /readyz and /buildinfo.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		httpjson.Write(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", a.handleReady)
+	mux.HandleFunc("GET /buildinfo", a.handleBuildInfo)
+	return mux
+}
+
+// handleReady runs every check and answers 503 if any of them fails.
+func (a *Admin) handleReady(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	checks := append([]namedCheck(nil), a.checks...)
+	a.mu.Unlock()
+
+	status, results := "ready", make(map[string]string, len(checks))
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := c.check(ctx)
+		cancel()
+		if err != nil {
+			status, results[c.name] = "not_ready", err.Error()
+		} else {
+			results[c.name] = "ok"
+		}
+	}
+
+	code := http.StatusOK
+	if status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	httpjson.Write(w, code, map[string]interface{}{"status": status, "checks": results})
+}
+
+func (a *Admin) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]string{"version": a.version, "go_version": runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info["module"] = build.Main.Path
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["revision"] = setting.Value
+			case "vcs.time":
+				info["revision_time"] = setting.Value
+			case "vcs.modified":
+				info["modified"] = setting.Value
+			}
+		}
+	}
+	httpjson.Write(w, http.StatusOK, info)
+}
+
+// StartupCheck returns a check that fails with reason until done is called,
+// so that an admin listener can serve liveness while the service is still
+// starting, such as while it waits for its first SVID.
+func StartupCheck(reason string) (check Check, done func()) {
+	var started atomic.Bool
+	check = func(context.Context) error {
+		if !started.Load() {
+			return errors.New(reason)
+		}
+		return nil
+	}
+	return check, func() { started.Store(true) }
+}
+
+// WorkloadAPICheck reports whether the Workload API at addr accepts
+// connections.
+func WorkloadAPICheck(addr string) Check {
+	return func(ctx context.Context) error {
+		network, address, err := workload.ParseAddr(addr)
+		if err != nil {
+			return err
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return fmt.Errorf("workload API unreachable: %w", err)
+		}
+		return conn.Close()
+	}
+}
+
+// BundleCheck reports whether source has a non-empty X.509 bundle for the
+// trust domain of its own SVID.
+func BundleCheck(source interface {
+	x509svid.Source
+	x509bundle.Source
+}) Check {
+	return func(ctx context.Context) error {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return err
+		}
+		bundle, err := source.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+		if err != nil {
+			return err
+		}
+		if len(bundle.X509Authorities()) == 0 {
+			return errors.New("trust bundle has no authorities")
+		}
+		return nil
+	}
+}
+
+// HTTPCheck reports whether the service at url answers through client. Any
+// response below 500 counts, since the probe is about reachability and the
+// TLS handshake, not about the routes the caller may use.
+func HTTPCheck(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("unreachable: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("answered %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	admin := New("v1.2.3")
+	ready := errors.New("not yet")
+	admin.AddCheck("dependency", func(context.Context) error { return ready })
+
+	testCases := []struct {
+		path   string
+		ready  error
+		status int
+		field  string
+		value  string
+	}{
+		{"/healthz", ready, http.StatusOK, "status", "ok"},
+		{"/readyz", ready, http.StatusServiceUnavailable, "status", "not_ready"},
+		{"/readyz", nil, http.StatusOK, "status", "ready"},
+		{"/buildinfo", nil, http.StatusOK, "version", "v1.2.3"},
+	}
+
+	for _, tc := range testCases {
+		ready = tc.ready
+		recorder := httptest.NewRecorder()
+		admin.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if recorder.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, recorder.Code)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: failed to decode response: %v", tc.path, err)
+		}
+		if body[tc.field] != tc.value {
+			t.Errorf("%s: expected %s %q, got %v", tc.path, tc.field, tc.value, body)
+		}
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	status := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := HTTPCheck(server.Client(), server.URL)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected a denied request to count as reachable, got %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected a server error to fail the check")
+	}
+	server.Close()
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected an unreachable server to fail the check")
+	}
+}
+
+func TestStartupCheck(t *testing.T) {
+	check, done := StartupCheck("waiting for an SVID")
+	if err := check(context.Background()); err == nil || err.Error() != "waiting for an SVID" {
+		t.Errorf("Expected the check to fail until startup is done, got %v", err)
+	}
+	done()
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected the check to pass once startup is done, got %v", err)
+	}
+}
+
+// fakeServer records how it was shut down.
+type fakeServer struct {
+	shutdownErr error
+	closed      bool
+}
+
+func (s *fakeServer) Shutdown(context.Context) error { return s.shutdownErr }
+func (s *fakeServer) Close() error                   { s.closed = true; return nil }
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	admin, err := Listen(ctx, "127.0.0.1:0", "v1.2.3", "unix:///nonexistent/workload.sock")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer admin.Close()
+	url := "http://" + admin.Addr().String()
+
+	readyChecks := func() map[string]interface{} {
+		t.Helper()
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			t.Fatalf("Failed to probe readiness: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		return body["checks"].(map[string]interface{})
+	}
+
+	if checks := readyChecks(); checks["startup"] == "ok" || checks["workload_api"] == "ok" || checks["shutdown"] != "ok" {
+		t.Errorf("Expected startup and the Workload API to fail readiness, got %v", checks)
+	}
+	admin.Started()
+	if checks := readyChecks(); checks["startup"] != "ok" {
+		t.Errorf("Expected startup to pass once started, got %v", checks)
+	}
+
+	// Draining fails readiness right away and closes the admin listener last
+	server := &fakeServer{shutdownErr: context.DeadlineExceeded}
+	drained := admin.Drain(ctx, server, 500*time.Millisecond, time.Second)
+	cancel()
+	if checks := readyChecks(); checks["shutdown"] == "ok" {
+		t.Errorf("Expected readiness to fail during the shutdown delay, got %v", checks)
+	}
+	<-drained
+	if !server.closed {
+		t.Error("Expected the remaining connections to be closed after the grace period")
+	}
+	if _, err := http.Get(url + "/healthz"); err == nil {
+		t.Error("Expected the admin listener to be closed once drained")
+	}
+}
@@ -0,0 +1,95 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Server is the admin listener of a service. It serves from before the wait
+// for the first SVID, so that liveness passes while readiness reports what
+// the service is still waiting for, until the service has drained.
+type Server struct {
+	*Admin
+	http    *http.Server
+	addr    net.Addr
+	started func()
+}
+
+// Listen serves the admin endpoints on addr with the checks of every
+// service: startup fails until Started is called, workload_api while the
+// Workload API at workloadAddr refuses connections, and shutdown once ctx is
+// done. version is reported on /buildinfo.
+func Listen(ctx context.Context, addr, version, workloadAddr string) (*Server, error) {
+	admin := New(version)
+	startup, started := StartupCheck("waiting for an X509-SVID from the Workload API")
+	admin.AddCheck("startup", startup)
+	admin.AddCheck("workload_api", WorkloadAPICheck(workloadAddr))
+	admin.AddCheck("shutdown", func(context.Context) error {
+		if ctx.Err() != nil {
+			return errors.New("shutting down")
+		}
+		return nil
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin address: %w", err)
+	}
+	s := &Server{Admin: admin, http: &http.Server{Handler: admin.Handler()}, addr: listener.Addr(), started: started}
+	go s.http.Serve(listener)
+	slog.Info("Admin listening", "addr", s.addr.String())
+	return s, nil
+}
+
+// Addr returns the address the admin endpoints are served on.
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+// Started ends the startup of the service, which the remaining checks then
+// describe.
+func (s *Server) Started() {
+	s.started()
+}
+
+// Close stops serving the admin endpoints.
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+// Shutdowner is a server that can be shut down gracefully, such as
+// http.Server.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// Drain shuts server down once ctx is done. Readiness fails right away, and
+// the listener of server stays open for delay so that load balancers stop
+// routing to it first. Requests in flight then get gracePeriod to finish,
+// after which the remaining connections and the admin listener are closed.
+// The returned channel is closed once server has stopped, and the Workload
+// API source may be closed.
+func (s *Server) Drain(ctx context.Context, server Shutdowner, delay, gracePeriod time.Duration) <-chan struct{} {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		slog.Info("Shutting down, failing readiness before closing the listener", "delay", delay)
+		time.Sleep(delay)
+		slog.Info("Draining requests", "grace_period", gracePeriod)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Grace period over, closing remaining connections", "error", err)
+			server.Close()
+		}
+		s.Close()
+	}()
+	return drained
+}
@@ -0,0 +1,36 @@
+// Package httpjson writes the JSON responses shared by the services, so that
+// clients see the same error format from each of them.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the JSON body returned when a request is rejected.
+type ErrorResponse struct {
+	Error    string `json:"error"`
+	Message  string `json:"message"`
+	SPIFFEID string `json:"spiffe_id,omitempty"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+}
+
+// Write replies with status and body encoded as JSON.
+func Write(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Error rejects r with status and an ErrorResponse. code is a short machine
+// readable reason such as "forbidden"; spiffeID is the caller, if known.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, message, spiffeID string) {
+	Write(w, status, ErrorResponse{
+		Error:    code,
+		Message:  message,
+		SPIFFEID: spiffeID,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+	})
+}
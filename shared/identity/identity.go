@@ -0,0 +1,172 @@
+// Package identity establishes the SPIFFE ID of the workload behind each
+// request, from its X509-SVID client certificate or a JWT-SVID bearer token,
+// and configures the mTLS servers that accept them.
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/meinsta/workload-id-demo/shared/httpjson"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Authentication methods reported in Caller.AuthMethod.
+const (
+	AuthMethodX509SVID = "x509-svid"
+	AuthMethodJWTSVID  = "jwt-svid"
+)
+
+// Caller is the authenticated workload behind a request.
+type Caller struct {
+	ID         spiffeid.ID
+	AuthMethod string
+}
+
+type callerKey struct{}
+
+// withCaller returns a copy of ctx carrying the authenticated caller.
+func withCaller(ctx context.Context, caller Caller) context.Context {
+	if slot, ok := ctx.Value(callerSlotKey{}).(*Caller); ok {
+		*slot = caller
+	}
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// callerSlotKey holds a *Caller that withCaller fills in, so that outer
+// middleware can see who an inner handler authenticated.
+type callerSlotKey struct{}
+
+// WithCallerSlot returns r carrying a caller slot for handlers further down
+// the chain to fill in, reusing the slot of an outer middleware.
+func WithCallerSlot(r *http.Request) (*http.Request, *Caller) {
+	if slot, ok := r.Context().Value(callerSlotKey{}).(*Caller); ok {
+		return r, slot
+	}
+	slot := &Caller{}
+	return r.WithContext(context.WithValue(r.Context(), callerSlotKey{}, slot)), slot
+}
+
+// ObservedCallerID returns the caller recorded in slot or, for requests that
+// were not authenticated, the SPIFFE ID of the client certificate if any.
+func ObservedCallerID(r *http.Request, slot *Caller) spiffeid.ID {
+	if !slot.ID.IsZero() {
+		return slot.ID
+	}
+	id, _ := PeerIDFromRequest(r)
+	return id
+}
+
+// CallerFromContext returns the caller authenticated by Authenticator.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// Authenticator establishes the caller's SPIFFE ID, either from the verified
+// mTLS client certificate or, when enabled, from a JWT-SVID bearer token, and
+// stores it in the request context for the policy layer and handlers.
+type Authenticator struct {
+	// bundles validates JWT-SVIDs; nil disables bearer authentication.
+	bundles  jwtbundle.Source
+	audience string
+	next     http.Handler
+}
+
+// NewAuthenticator wraps next. Bearer tokens are only accepted when bundles
+// is set, and must carry audience.
+func NewAuthenticator(bundles jwtbundle.Source, audience string, next http.Handler) *Authenticator {
+	return &Authenticator{bundles: bundles, audience: audience, next: next}
+}
+
+func (a *Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, err := a.authenticate(r)
+	switch {
+	case errors.Is(err, ErrNoCredentials):
+		// Let the policy layer reject the request with a consistent error
+	case err != nil:
+		slog.Info("Authentication failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		httpjson.Error(w, r, http.StatusUnauthorized, "unauthenticated", err.Error(), "")
+		return
+	default:
+		r = r.WithContext(withCaller(r.Context(), caller))
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+// ErrNoCredentials is returned for requests without a client certificate or
+// bearer token.
+var ErrNoCredentials = errors.New("no client certificate or bearer token presented")
+
+// authenticate prefers the mTLS client certificate; an Authorization header
+// is ignored when one was presented.
+func (a *Authenticator) authenticate(r *http.Request) (Caller, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		id, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+		if err != nil {
+			return Caller{}, fmt.Errorf("client certificate has no SPIFFE ID: %w", err)
+		}
+		return Caller{ID: id, AuthMethod: AuthMethodX509SVID}, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if a.bundles == nil || header == "" {
+		return Caller{}, ErrNoCredentials
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return Caller{}, errors.New("authorization header is not a bearer token")
+	}
+	svid, err := jwtsvid.ParseAndValidate(strings.TrimSpace(token), a.bundles, []string{a.audience})
+	if err != nil {
+		return Caller{}, fmt.Errorf("invalid JWT-SVID: %w", err)
+	}
+	return Caller{ID: svid.ID, AuthMethod: AuthMethodJWTSVID}, nil
+}
+
+// PeerIDFromRequest returns the SPIFFE ID of the caller, as established by
+// Authenticator or, for requests that did not pass through it, from the
+// verified mTLS client certificate.
+func PeerIDFromRequest(r *http.Request) (spiffeid.ID, error) {
+	if caller, ok := CallerFromContext(r.Context()); ok {
+		return caller.ID, nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return spiffeid.ID{}, ErrNoCredentials
+	}
+	id, err := x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return spiffeid.ID{}, fmt.Errorf("client certificate has no SPIFFE ID: %w", err)
+	}
+	return id, nil
+}
+
+// ServerTLSConfig requires an X509-SVID from every client. When bearer
+// authentication is enabled the client certificate becomes optional, so that
+// callers behind TLS-terminating proxies can connect, but a certificate that
+// is presented is still verified and authorized during the handshake.
+func ServerTLSConfig(svid x509svid.Source, bundles x509bundle.Source, authorizer tlsconfig.Authorizer, optionalClientCert bool) *tls.Config {
+	config := tlsconfig.MTLSServerConfig(svid, bundles, authorizer)
+	if optionalClientCert {
+		verify := config.VerifyPeerCertificate
+		config.ClientAuth = tls.RequestClientCert
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return nil
+			}
+			return verify(rawCerts, chains)
+		}
+	}
+	return config
+}
@@ -0,0 +1,106 @@
+package identity
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestAuthenticatorJWTSVID(t *testing.T) {
+	issuer := workloadtest.NewJWTIssuer(t, "example.com")
+	bundle, sign := issuer.Bundle(), issuer.Sign
+	handler := NewAuthenticator(bundle, "backend", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := CallerFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("X-Caller", caller.ID.String())
+		w.Header().Set("X-Auth-Method", caller.AuthMethod)
+	}))
+
+	valid := time.Now().Add(5 * time.Minute)
+	testCases := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{"valid_token", "Bearer " + sign("spiffe://example.com/web", []string{"backend"}, valid), http.StatusOK},
+		{"wrong_audience", "Bearer " + sign("spiffe://example.com/web", []string{"other"}, valid), http.StatusUnauthorized},
+		{"expired", "Bearer " + sign("spiffe://example.com/web", []string{"backend"}, time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"not_bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		// Left to the policy layer, which sees no caller
+		{"no_credentials", "", http.StatusNoContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/whoami", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tc.expected {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expected, w.Code, w.Body.String())
+			}
+			if w.Code == http.StatusOK {
+				if got := w.Header().Get("X-Caller"); got != "spiffe://example.com/web" {
+					t.Errorf("Expected caller spiffe://example.com/web, got %q", got)
+				}
+				if got := w.Header().Get("X-Auth-Method"); got != AuthMethodJWTSVID {
+					t.Errorf("Expected auth method %s, got %q", AuthMethodJWTSVID, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatorPrefersClientCertificate(t *testing.T) {
+	var got, slot Caller
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, s := WithCallerSlot(r)
+		NewAuthenticator(nil, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = CallerFromContext(r.Context())
+		})).ServeHTTP(w, r)
+		slot = *s
+	})
+
+	uri, _ := url.Parse("spiffe://example.com/web")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{uri}}}}
+	req.Header.Set("Authorization", "Bearer ignored")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.ID.String() != "spiffe://example.com/web" || got.AuthMethod != AuthMethodX509SVID {
+		t.Errorf("Expected X509-SVID caller spiffe://example.com/web, got %+v", got)
+	}
+	if slot != got {
+		t.Errorf("Expected the caller slot to be filled in with %+v, got %+v", got, slot)
+	}
+}
+
+func TestServerTLSConfigClientAuth(t *testing.T) {
+	required := ServerTLSConfig(nil, nil, nil, false)
+	if required.ClientAuth != tls.RequireAnyClientCert {
+		t.Errorf("Expected client certificates to be required, got %v", required.ClientAuth)
+	}
+
+	optional := ServerTLSConfig(nil, nil, nil, true)
+	if optional.ClientAuth != tls.RequestClientCert {
+		t.Errorf("Expected client certificates to be optional, got %v", optional.ClientAuth)
+	}
+	if err := optional.VerifyPeerCertificate(nil, nil); err != nil {
+		t.Errorf("Expected connections without a client certificate to be accepted, got %v", err)
+	}
+	if err := optional.VerifyPeerCertificate([][]byte{[]byte("garbage")}, nil); err == nil {
+		t.Error("Expected a presented client certificate to still be verified")
+	}
+}
@@ -0,0 +1,147 @@
+// Package metrics exports the identity of a service to Prometheus, so that
+// alerts can fire before an SVID lapses, and classifies TLS handshake
+// failures into the label values both services use.
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// BundleLister lists every X.509 bundle of a service, including federated
+// ones. workload.X509Bundles and x509bundle.Set implement it.
+type BundleLister interface {
+	Bundles() []*x509bundle.Bundle
+}
+
+// Registry is a Prometheus registry with the SVID metrics of a service. The
+// service registers its own metrics next to them.
+type Registry struct {
+	*prometheus.Registry
+	rotations    prometheus.Counter
+	lastRotation prometheus.Gauge
+}
+
+// NewRegistry creates a registry exporting the SVIDs of source. SVID expiry
+// and the size of every bundle in bundles are read on every scrape.
+func NewRegistry(source x509svid.Source, bundles BundleLister) *Registry {
+	r := &Registry{
+		Registry: prometheus.NewRegistry(),
+		rotations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "svid_rotations_total",
+			Help: "Number of times a new X509-SVID was received from the Workload API.",
+		}),
+		lastRotation: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "svid_last_rotation_timestamp_seconds",
+			Help: "Unix time at which the current X509-SVID was received.",
+		}),
+	}
+	r.lastRotation.SetToCurrentTime()
+	r.MustRegister(r.rotations, r.lastRotation, &svidCollector{source: source, bundles: bundles})
+	return r
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRotation records that a new X509-SVID replaced the previous one.
+func (r *Registry) ObserveRotation(_, _ *x509svid.SVID) {
+	r.rotations.Inc()
+	r.lastRotation.SetToCurrentTime()
+}
+
+// HandshakeErrorReason classifies a handshake error by its type where the
+// standard library gives it one, and by its message otherwise.
+func HandshakeErrorReason(err error) string {
+	var (
+		invalid x509.CertificateInvalidError
+		unknown x509.UnknownAuthorityError
+		header  tls.RecordHeaderError
+		opErr   *net.OpError
+	)
+	switch {
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "expired_certificate"
+	case errors.As(err, &unknown):
+		return "unknown_authority"
+	case errors.As(err, &header):
+		return "not_tls"
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		return "rejected_by_peer"
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return "connection_closed"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return HandshakeFailureReason(err.Error())
+}
+
+// HandshakeFailureReason classifies a handshake error message into a small
+// set of label values. go-spiffe reports verification failures as plain
+// errors, which only their message tells apart.
+func HandshakeFailureReason(message string) string {
+	switch {
+	case strings.Contains(message, "certificate has expired or is not yet valid"):
+		return "expired_certificate"
+	case strings.Contains(message, "unknown authority"):
+		return "unknown_authority"
+	case strings.Contains(message, "didn't provide a certificate"):
+		return "no_certificate"
+	case strings.Contains(message, "no approved client rule matched"),
+		strings.Contains(message, "unexpected ID"),
+		strings.Contains(message, "unexpected trust domain"):
+		return "unauthorized"
+	case strings.Contains(message, "remote error"):
+		return "rejected_by_peer"
+	case strings.Contains(message, "does not look like a TLS handshake"):
+		return "not_tls"
+	case strings.Contains(message, "EOF"), strings.Contains(message, "connection reset"):
+		return "connection_closed"
+	default:
+		return "other"
+	}
+}
+
+// svidCollector reads the current SVID and bundles on every scrape.
+type svidCollector struct {
+	source  x509svid.Source
+	bundles BundleLister
+}
+
+var (
+	svidExpiryDesc = prometheus.NewDesc("svid_expiry_seconds",
+		"Seconds until the current X509-SVID expires, negative once it has.", []string{"spiffe_id"}, nil)
+	bundleSizeDesc = prometheus.NewDesc("trust_bundle_certificates",
+		"Number of X.509 authorities in the trust bundle of each trust domain.", []string{"trust_domain"}, nil)
+)
+
+func (c *svidCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- svidExpiryDesc
+	ch <- bundleSizeDesc
+}
+
+func (c *svidCollector) Collect(ch chan<- prometheus.Metric) {
+	if svid, err := c.source.GetX509SVID(); err == nil {
+		ch <- prometheus.MustNewConstMetric(svidExpiryDesc, prometheus.GaugeValue,
+			time.Until(svid.Certificates[0].NotAfter).Seconds(), svid.ID.String())
+	}
+	for _, bundle := range c.bundles.Bundles() {
+		ch <- prometheus.MustNewConstMetric(bundleSizeDesc, prometheus.GaugeValue,
+			float64(len(bundle.X509Authorities())), bundle.TrustDomain().String())
+	}
+}
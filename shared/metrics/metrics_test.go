@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestHandshakeFailureReason(t *testing.T) {
+	testCases := map[string]string{
+		"x509svid: could not verify leaf certificate: x509: certificate has expired or is not yet valid": "expired_certificate",
+		"x509svid: could not verify leaf certificate: x509: certificate signed by unknown authority":     "unknown_authority",
+		"tls: client didn't provide a certificate":                                                       "no_certificate",
+		`unexpected ID "spiffe://example.com/intruder": no approved client rule matched`:                 "unauthorized",
+		"remote error: tls: bad certificate":                                                             "rejected_by_peer",
+		"EOF":                                                                                            "connection_closed",
+		"something new":                                                                                  "other",
+	}
+	for message, expected := range testCases {
+		if reason := HandshakeFailureReason(message); reason != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, message, reason)
+		}
+	}
+}
+
+func TestHandshakeErrorReason(t *testing.T) {
+	testCases := map[string]error{
+		"expired_certificate": fmt.Errorf("x509svid: could not verify leaf certificate: %w", x509.CertificateInvalidError{Reason: x509.Expired}),
+		"unknown_authority":   fmt.Errorf("x509svid: could not verify leaf certificate: %w", x509.UnknownAuthorityError{}),
+		"not_tls":             tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+		"rejected_by_peer":    &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")},
+		"connection_closed":   io.EOF,
+		"timeout":             context.DeadlineExceeded,
+		"unauthorized":        errors.New(`unexpected ID "spiffe://example.com/intruder": no approved client rule matched`),
+		"other":               errors.New("something new"),
+	}
+	for expected, err := range testCases {
+		if reason := HandshakeErrorReason(err); reason != expected {
+			t.Errorf("Expected %s for %v, got %s", expected, err, reason)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	api := workloadtest.New(t, "spiffe://example.com/backend")
+	source := api.X509Source(t, "spiffe://example.com/backend")
+	own, err := source.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("example.com"))
+	if err != nil {
+		t.Fatalf("Failed to get bundle: %v", err)
+	}
+	partner := x509bundle.FromX509Authorities(spiffeid.RequireTrustDomainFromString("partner.org"), own.X509Authorities())
+	registry := NewRegistry(source, x509bundle.NewSet(own, partner))
+	registry.ObserveRotation(nil, nil)
+
+	expected := `
+# HELP svid_rotations_total Number of times a new X509-SVID was received from the Workload API.
+# TYPE svid_rotations_total counter
+svid_rotations_total 1
+# HELP trust_bundle_certificates Number of X.509 authorities in the trust bundle of each trust domain.
+# TYPE trust_bundle_certificates gauge
+trust_bundle_certificates{trust_domain="example.com"} 1
+trust_bundle_certificates{trust_domain="partner.org"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "svid_rotations_total", "trust_bundle_certificates"); err != nil {
+		t.Errorf("Unexpected metrics: %v", err)
+	}
+
+	// The expiry is read from the current SVID on every scrape
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "svid_expiry_seconds" {
+			continue
+		}
+		if expiry := family.GetMetric()[0].GetGauge().GetValue(); expiry <= 0 || expiry > time.Hour.Seconds() {
+			t.Errorf("Expected the SVID to expire within the hour, got %vs", expiry)
+		}
+		return
+	}
+	t.Error("Expected svid_expiry_seconds to be exported")
+}
@@ -0,0 +1,54 @@
+package svidwatch
+
+import (
+	"context"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Monitor follows the X509-SVID of a service: it logs every rotation, keeps
+// their history and runs the expiry watchdog.
+type Monitor struct {
+	History  *History
+	Watchdog *Watchdog
+
+	err chan error
+}
+
+// Start records the current SVID of source, checks it and follows its
+// rotations until ctx is done, calling each of onRotate on every rotation.
+// With ExitOnExpiry in config an expired SVID calls stop, so that the
+// orchestrator restarts the service, and is then reported by Err. Start
+// must be the only consumer of source.Updated.
+func Start(ctx context.Context, stop func(), source RotatingSource, config WatchdogConfig, onRotate ...func(old, new *x509svid.SVID)) *Monitor {
+	m := &Monitor{
+		History:  NewHistory(HistorySize),
+		Watchdog: NewWatchdog(source, config),
+		err:      make(chan error, 1),
+	}
+	if svid, err := source.GetX509SVID(); err == nil {
+		m.History.Observe(nil, svid)
+	}
+	m.Watchdog.Check()
+
+	observers := append([]func(old, new *x509svid.SVID){LogRotation, m.History.Observe}, onRotate...)
+	go Watch(ctx, source, append(observers, m.Watchdog.ObserveRotation)...)
+	go func() {
+		if err := m.Watchdog.Run(ctx); err != nil {
+			m.err <- err
+			stop()
+		}
+	}()
+	return m
+}
+
+// Err returns ErrExpired once an expired SVID stopped the service, and nil
+// otherwise.
+func (m *Monitor) Err() error {
+	select {
+	case err := <-m.err:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package svidwatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// rotatingSource is a RotatingSource whose SVID is replaced by rotate
+type rotatingSource struct {
+	mu      sync.Mutex
+	svid    *x509svid.SVID
+	updated chan struct{}
+}
+
+func (s *rotatingSource) GetX509SVID() (*x509svid.SVID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.svid, nil
+}
+
+func (s *rotatingSource) Updated() <-chan struct{} {
+	return s.updated
+}
+
+// rotate replaces the SVID once Watch has read the previous one, which it
+// has when it takes an update
+func (s *rotatingSource) rotate(svid *x509svid.SVID) {
+	s.updated <- struct{}{}
+	s.mu.Lock()
+	s.svid = svid
+	s.mu.Unlock()
+	s.updated <- struct{}{}
+}
+
+func TestStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &rotatingSource{svid: expiringSVID(time.Hour), updated: make(chan struct{})}
+	source.svid.Certificates[0].SerialNumber = testSVID(1).Certificates[0].SerialNumber
+
+	rotated := make(chan *x509svid.SVID, 1)
+	monitor := Start(ctx, cancel, source, DefaultWatchdogConfig(), func(_, new *x509svid.SVID) { rotated <- new })
+	if len(monitor.History.Rotations()) != 1 {
+		t.Errorf("Expected the current SVID in the history, got %+v", monitor.History.Rotations())
+	}
+
+	next := testSVID(2)
+	source.rotate(next)
+	if svid := <-rotated; svid != next {
+		t.Errorf("Expected the rotated SVID to be passed on, got %v", svid)
+	}
+	if len(monitor.History.Rotations()) != 2 {
+		t.Errorf("Expected the rotation in the history, got %+v", monitor.History.Rotations())
+	}
+	if monitor.Err() != nil {
+		t.Errorf("Expected no error while the service runs, got %v", monitor.Err())
+	}
+}
+
+func TestStartExitOnExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	config := DefaultWatchdogConfig()
+	config.Interval = 10 * time.Millisecond
+	config.ExitOnExpiry = true
+
+	stopped, stop := context.WithCancel(ctx)
+	monitor := Start(ctx, stop, &rotatingSource{svid: expiringSVID(-time.Second)}, config)
+	<-stopped.Done()
+	if err := monitor.Err(); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected %v once the service was stopped, got %v", ErrExpired, err)
+	}
+}
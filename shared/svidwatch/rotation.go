@@ -0,0 +1,136 @@
+// Package svidwatch follows the X509-SVIDs of a service as they are rotated,
+// keeping a history of rotations and raising the alarm before one lapses.
+package svidwatch
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// HistorySize is the number of rotations kept for /rotations.
+const HistorySize = 32
+
+// RotatingSource is an X509 source that signals updates, such as
+// workloadapi.X509Source.
+type RotatingSource interface {
+	x509svid.Source
+	Updated() <-chan struct{}
+}
+
+// Watch calls each of onRotate whenever source delivers an X509-SVID
+// with a new serial number, until ctx is done. It must be the only consumer
+// of source.Updated.
+func Watch(ctx context.Context, source RotatingSource, onRotate ...func(old, new *x509svid.SVID)) {
+	current, _ := source.GetX509SVID()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-source.Updated():
+		}
+
+		next, err := source.GetX509SVID()
+		if err != nil {
+			continue
+		}
+		if current == nil || next.Certificates[0].SerialNumber.Cmp(current.Certificates[0].SerialNumber) != 0 {
+			for _, fn := range onRotate {
+				fn(current, next)
+			}
+			current = next
+		}
+	}
+}
+
+// LogRotation logs that new replaced old.
+func LogRotation(old, new *x509svid.SVID) {
+	if old == nil {
+		slog.Info("SVID received", "spiffe_id", new.ID.String(), "serial", Serial(new),
+			"not_after", new.Certificates[0].NotAfter.Format(time.RFC3339))
+		return
+	}
+	slog.Info("SVID rotated",
+		"old_spiffe_id", old.ID.String(), "spiffe_id", new.ID.String(),
+		"old_serial", Serial(old), "serial", Serial(new),
+		"old_not_after", old.Certificates[0].NotAfter.Format(time.RFC3339),
+		"not_after", new.Certificates[0].NotAfter.Format(time.RFC3339))
+}
+
+// Serial returns the serial number of svid in hex, as it is logged.
+func Serial(svid *x509svid.SVID) string {
+	return svid.Certificates[0].SerialNumber.Text(16)
+}
+
+// Rotation is one X509-SVID change. The Old fields are empty for the SVID
+// received at startup.
+type Rotation struct {
+	Time        time.Time  `json:"time"`
+	OldSPIFFEID string     `json:"old_spiffe_id,omitempty"`
+	OldSerial   string     `json:"old_serial,omitempty"`
+	OldNotAfter *time.Time `json:"old_not_after,omitempty"`
+	SPIFFEID    string     `json:"spiffe_id"`
+	Serial      string     `json:"serial"`
+	NotAfter    time.Time  `json:"not_after"`
+}
+
+// History keeps the most recent rotations in a ring buffer.
+type History struct {
+	mu      sync.Mutex
+	entries []Rotation
+	next    int
+	full    bool
+}
+
+// NewHistory creates a history of at most size rotations.
+func NewHistory(size int) *History {
+	return &History{entries: make([]Rotation, size)}
+}
+
+// Observe records that new replaced old, overwriting the oldest entry once
+// the history is full.
+func (h *History) Observe(old, new *x509svid.SVID) {
+	rotation := Rotation{
+		Time:     time.Now().UTC(),
+		SPIFFEID: new.ID.String(),
+		Serial:   Serial(new),
+		NotAfter: new.Certificates[0].NotAfter,
+	}
+	if old != nil {
+		notAfter := old.Certificates[0].NotAfter
+		rotation.OldSPIFFEID = old.ID.String()
+		rotation.OldSerial = Serial(old)
+		rotation.OldNotAfter = &notAfter
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = rotation
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Rotations returns the recorded rotations, oldest first.
+func (h *History) Rotations() []Rotation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]Rotation(nil), h.entries[:h.next]...)
+	}
+	return append(append([]Rotation(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// Handler serves the recorded rotations as JSON.
+func (h *History) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"rotations": h.Rotations()})
+	})
+}
@@ -0,0 +1,49 @@
+package svidwatch
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+const testID = "spiffe://example.com/backend"
+
+func testSVID(serial int64) *x509svid.SVID {
+	return &x509svid.SVID{
+		ID: spiffeid.RequireFromString(testID),
+		Certificates: []*x509.Certificate{{
+			SerialNumber: big.NewInt(serial),
+			NotAfter:     time.Unix(serial, 0),
+		}},
+	}
+}
+
+func TestHistory(t *testing.T) {
+	history := NewHistory(3)
+	if rotations := history.Rotations(); len(rotations) != 0 {
+		t.Fatalf("Expected an empty history, got %v", rotations)
+	}
+
+	history.Observe(nil, testSVID(1))
+	for serial := int64(2); serial <= 5; serial++ {
+		history.Observe(testSVID(serial-1), testSVID(serial))
+	}
+
+	rotations := history.Rotations()
+	if len(rotations) != 3 {
+		t.Fatalf("Expected the last 3 rotations, got %d", len(rotations))
+	}
+	for i, rotation := range rotations {
+		serial := int64(i + 3)
+		if rotation.Serial != big.NewInt(serial).Text(16) || rotation.OldSerial != big.NewInt(serial-1).Text(16) {
+			t.Errorf("Expected rotation %d to be %d → %d, got %s → %s", i, serial-1, serial, rotation.OldSerial, rotation.Serial)
+		}
+		if !rotation.NotAfter.Equal(time.Unix(serial, 0)) || rotation.OldNotAfter == nil {
+			t.Errorf("Expected rotation %d to record both expiries, got %+v", i, rotation)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package svidwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// SVID levels reported by the Watchdog, from healthy to lapsed.
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+	LevelExpired  = "expired"
+)
+
+// ErrExpired is returned by Watchdog.Run when the SVID has expired and
+// the watchdog is configured to exit.
+var ErrExpired = errors.New("X509-SVID expired without being rotated")
+
+// WatchdogConfig sets when the Watchdog raises the alarm about the remaining
+// lifetime of the current SVID.
+type WatchdogConfig struct {
+	Warn         time.Duration `yaml:"warn_threshold"`     // Log a warning below this remaining lifetime
+	Critical     time.Duration `yaml:"critical_threshold"` // Rotation is considered stalled below this remaining lifetime
+	Interval     time.Duration `yaml:"interval"`           // How often the SVID is checked
+	ExitOnExpiry bool          `yaml:"exit_on_expiry"`     // Stop the process once the SVID has expired
+}
+
+// DefaultWatchdogConfig warns two minutes before expiry and fails readiness
+// thirty seconds before, by which time tbot should long have rotated.
+func DefaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		Warn:     2 * time.Minute,
+		Critical: 30 * time.Second,
+		Interval: 5 * time.Second,
+	}
+}
+
+// ParseWatchdogConfig overrides config with the <prefix>_SVID_WARN_THRESHOLD,
+// <prefix>_SVID_CRITICAL_THRESHOLD and <prefix>_SVID_EXIT_ON_EXPIRY variables.
+func ParseWatchdogConfig(prefix string, config *WatchdogConfig) error {
+	var overridden bool
+	for key, threshold := range map[string]*time.Duration{
+		prefix + "_SVID_WARN_THRESHOLD":     &config.Warn,
+		prefix + "_SVID_CRITICAL_THRESHOLD": &config.Critical,
+	} {
+		if value := os.Getenv(key); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < 0 {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			*threshold = duration
+			overridden = true
+		}
+	}
+	// Thresholds from the config file are checked by Validate
+	if overridden && config.Critical > config.Warn {
+		return fmt.Errorf("%s_SVID_CRITICAL_THRESHOLD (%v) must not exceed %s_SVID_WARN_THRESHOLD (%v)",
+			prefix, config.Critical, prefix, config.Warn)
+	}
+	if value := os.Getenv(prefix + "_SVID_EXIT_ON_EXPIRY"); value != "" {
+		exit, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s_SVID_EXIT_ON_EXPIRY %q", prefix, value)
+		}
+		config.ExitOnExpiry = exit
+	}
+	return nil
+}
+
+// Validate checks that the thresholds are ordered and the interval positive.
+func (c WatchdogConfig) Validate() error {
+	switch {
+	case c.Warn < 0 || c.Critical < 0:
+		return fmt.Errorf("thresholds must not be negative, got %v and %v", c.Warn, c.Critical)
+	case c.Critical > c.Warn:
+		return fmt.Errorf("critical_threshold (%v) must not exceed warn_threshold (%v)", c.Critical, c.Warn)
+	case c.Interval <= 0:
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	return nil
+}
+
+// Watchdog checks the current SVID against the thresholds of its config and
+// reports readiness. Only the SVID level, not the individual checks, is
+// logged, so a lapsing SVID logs once per level.
+type Watchdog struct {
+	source x509svid.Source
+	config WatchdogConfig
+
+	mu     sync.Mutex
+	level  string
+	reason string
+}
+
+// NewWatchdog creates a watchdog of the SVIDs of source.
+func NewWatchdog(source x509svid.Source, config WatchdogConfig) *Watchdog {
+	return &Watchdog{source: source, config: config}
+}
+
+// Run checks the SVID every interval until ctx is done. With ExitOnExpiry it
+// returns ErrExpired once the SVID has expired.
+func (w *Watchdog) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		if w.Check() == LevelExpired && w.config.ExitOnExpiry {
+			return ErrExpired
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ObserveRotation re-checks the SVID as soon as it is rotated.
+func (w *Watchdog) ObserveRotation(_, _ *x509svid.SVID) {
+	w.Check()
+}
+
+// Check evaluates the current SVID, logs when its level changes and returns
+// the new level.
+func (w *Watchdog) Check() string {
+	level, reason := w.evaluate(time.Now())
+
+	w.mu.Lock()
+	changed := level != w.level
+	w.level, w.reason = level, reason
+	w.mu.Unlock()
+
+	if changed {
+		switch level {
+		case LevelOK:
+			slog.Info("SVID watchdog", "level", level, "detail", reason)
+		case LevelWarning:
+			slog.Warn("SVID watchdog", "level", level, "detail", reason)
+		default:
+			slog.Error("SVID watchdog, failing readiness", "level", level, "detail", reason)
+		}
+	}
+	return level
+}
+
+// evaluate returns the level of the current SVID at now and why.
+func (w *Watchdog) evaluate(now time.Time) (string, string) {
+	svid, err := w.source.GetX509SVID()
+	if err != nil {
+		return LevelExpired, fmt.Sprintf("no X509-SVID: %v", err)
+	}
+	remaining := svid.Certificates[0].NotAfter.Sub(now)
+	switch {
+	case remaining <= 0:
+		return LevelExpired, fmt.Sprintf("%s expired %v ago", svid.ID, -remaining.Truncate(time.Second))
+	case remaining < w.config.Critical:
+		return LevelCritical, fmt.Sprintf("%s expires in %v, rotation has stalled", svid.ID, remaining.Truncate(time.Second))
+	case remaining < w.config.Warn:
+		return LevelWarning, fmt.Sprintf("%s expires in %v", svid.ID, remaining.Truncate(time.Second))
+	default:
+		return LevelOK, fmt.Sprintf("%s expires in %v", svid.ID, remaining.Truncate(time.Second))
+	}
+}
+
+// Ready returns why the service is not ready, or nil while the SVID is not
+// critical or expired.
+func (w *Watchdog) Ready() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.level == LevelCritical || w.level == LevelExpired {
+		return errors.New(w.reason)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package svidwatch
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// mockSource is an x509svid.Source with a fixed SVID
+type mockSource struct {
+	svid *x509svid.SVID
+}
+
+func (m *mockSource) GetX509SVID() (*x509svid.SVID, error) {
+	return m.svid, nil
+}
+
+func expiringSVID(expiresIn time.Duration) *x509svid.SVID {
+	return &x509svid.SVID{
+		ID:           spiffeid.RequireFromString(testID),
+		Certificates: []*x509.Certificate{{NotAfter: time.Now().Add(expiresIn)}},
+	}
+}
+func TestWatchdog(t *testing.T) {
+	testCases := []struct {
+		name      string
+		expiresIn time.Duration
+		level     string
+		ready     bool
+	}{
+		{"fresh", 10 * time.Minute, LevelOK, true},
+		{"warning", time.Minute, LevelWarning, true},
+		{"stalled", 10 * time.Second, LevelCritical, false},
+		{"expired", -time.Minute, LevelExpired, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			watchdog := NewWatchdog(&mockSource{svid: expiringSVID(tc.expiresIn)}, DefaultWatchdogConfig())
+			if level := watchdog.Check(); level != tc.level {
+				t.Errorf("Expected level %s, got %s", tc.level, level)
+			}
+			if err := watchdog.Ready(); (err == nil) != tc.ready {
+				t.Errorf("Expected ready=%v, got %v", tc.ready, err)
+			}
+		})
+	}
+}
+
+func TestWatchdogRecovers(t *testing.T) {
+	source := &mockSource{svid: expiringSVID(-time.Second)}
+	watchdog := NewWatchdog(source, DefaultWatchdogConfig())
+	watchdog.Check()
+	if watchdog.Ready() == nil {
+		t.Fatal("Expected an expired SVID to fail readiness")
+	}
+
+	source.svid = expiringSVID(time.Hour)
+	watchdog.ObserveRotation(nil, source.svid)
+	if err := watchdog.Ready(); err != nil {
+		t.Errorf("Expected a rotated SVID to restore readiness, got %v", err)
+	}
+}
+
+func TestWatchdogExitOnExpiry(t *testing.T) {
+	config := DefaultWatchdogConfig()
+	config.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Without ExitOnExpiry the watchdog keeps running until ctx is done
+	stop, stopCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stopCancel()
+	if err := NewWatchdog(&mockSource{svid: expiringSVID(-time.Second)}, config).Run(stop); err != nil {
+		t.Errorf("Expected no error without ExitOnExpiry, got %v", err)
+	}
+
+	config.ExitOnExpiry = true
+	if err := NewWatchdog(&mockSource{svid: expiringSVID(-time.Second)}, config).Run(ctx); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected %v, got %v", ErrExpired, err)
+	}
+}
+
+func TestParseWatchdogConfig(t *testing.T) {
+	t.Setenv("TEST_SVID_WARN_THRESHOLD", "5m")
+	t.Setenv("TEST_SVID_CRITICAL_THRESHOLD", "1m")
+	t.Setenv("TEST_SVID_EXIT_ON_EXPIRY", "true")
+	config := DefaultWatchdogConfig()
+	if err := ParseWatchdogConfig("TEST", &config); err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if config.Warn != 5*time.Minute || config.Critical != time.Minute || !config.ExitOnExpiry {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	t.Setenv("TEST_SVID_CRITICAL_THRESHOLD", "10m")
+	if err := ParseWatchdogConfig("TEST", &config); err == nil {
+		t.Error("Expected a critical threshold above the warning threshold to be rejected")
+	}
+}
@@ -0,0 +1,32 @@
+// Package telemetry sets up the structured logs and the traces of a service.
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogConfig selects the format and minimum level of the logs.
+type LogConfig struct {
+	Format string `yaml:"format"` // "text" or "json"
+	Level  string `yaml:"level"`  // "debug", "info", "warn" or "error"
+}
+
+// NewLogger creates a logger writing to w as configured.
+func NewLogger(w io.Writer, config LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", config.Level)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(config.Format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", config.Format)
+	}
+}
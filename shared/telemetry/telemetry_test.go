@@ -0,0 +1,102 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, LogConfig{Format: "json", Level: "warn"})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["key"] != "value" {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	for _, config := range []LogConfig{{Format: "xml", Level: "info"}, {Format: "text", Level: "loud"}} {
+		if _, err := NewLogger(&buf, config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	var buf bytes.Buffer
+	provider, shutdown, err := NewTracerProvider(context.Background(), &buf, TraceConfig{Exporter: "stdout", ServiceName: "test"}, "v1.2.3")
+	if err != nil {
+		t.Fatalf("Failed to create tracer provider: %v", err)
+	}
+	ctx, span := provider.Tracer("test").Start(context.Background(), "operation")
+	if attrs := TraceAttrs(ctx); len(attrs) != 1 || attrs[0].Value.String() != span.SpanContext().TraceID().String() {
+		t.Errorf("Expected the trace ID of the span, got %v", attrs)
+	}
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to flush spans: %v", err)
+	}
+
+	var exported struct {
+		Name     string
+		Resource []struct {
+			Key   string
+			Value struct{ Value interface{} }
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("Expected a single JSON span, got %q: %v", buf.String(), err)
+	}
+	resource := map[string]interface{}{}
+	for _, attr := range exported.Resource {
+		resource[attr.Key] = attr.Value.Value
+	}
+	if exported.Name != "operation" || resource["service.name"] != "test" || resource["service.version"] != "v1.2.3" {
+		t.Errorf("Unexpected span %s with resource %v", exported.Name, resource)
+	}
+
+	if TraceAttrs(context.Background()) != nil {
+		t.Error("Expected no trace ID outside a span")
+	}
+	if err := (TraceConfig{Exporter: "jaeger"}).Validate(); err == nil {
+		t.Error("Expected an unknown exporter to be rejected")
+	}
+	if attrs := TLSAttributes(&tls.ConnectionState{Version: tls.VersionTLS13}); len(attrs) != 3 {
+		t.Errorf("Expected the version, cipher and resumption, got %v", attrs)
+	}
+}
+
+func TestRouteSpanName(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whoami", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("POST /rotations", func(http.ResponseWriter, *http.Request) {})
+	mux.Handle("/static/", http.NotFoundHandler())
+	name := RouteSpanName(mux)
+
+	testCases := []struct {
+		method, path, expected string
+	}{
+		{"GET", "/whoami", "GET /whoami"},
+		{"POST", "/rotations", "POST /rotations"},
+		{"GET", "/static/css/site.css", "GET /static/"},
+		{"GET", "/unknown/1234", "GET"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := name("", r); got != tc.expected {
+			t.Errorf("Expected %s for %s %s, got %s", tc.expected, tc.method, tc.path, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Propagator carries trace context between services in the W3C traceparent
+// and tracestate headers.
+var Propagator = propagation.TraceContext{}
+
+// TraceConfig selects where the spans of the service are exported.
+type TraceConfig struct {
+	Exporter    string `yaml:"exporter"` // "none", "stdout" or "otlp"
+	ServiceName string `yaml:"service_name"`
+}
+
+// Validate checks that the exporter is known.
+func (c TraceConfig) Validate() error {
+	switch strings.ToLower(c.Exporter) {
+	case "none", "stdout", "otlp":
+		return nil
+	default:
+		return fmt.Errorf("invalid trace exporter %q: must be none, stdout or otlp", c.Exporter)
+	}
+}
+
+// NewTracerProvider creates the tracer provider for config and a function
+// that flushes it, attributing spans to config.ServiceName at version. With
+// "stdout" spans are written to w as JSON, with "otlp" they are sent over
+// OTLP/HTTP to the collector at OTEL_EXPORTER_OTLP_ENDPOINT (default
+// localhost:4318). With "none" no spans are recorded and no trace is
+// started; the trace context of an incoming request that already carries one
+// is still passed on to the calls made while serving it.
+func NewTracerProvider(ctx context.Context, w io.Writer, config TraceConfig, version string) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(config.Exporter) {
+	case "none":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, nil, fmt.Errorf("invalid trace exporter %q: must be none, stdout or otlp", config.Exporter)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(config.ServiceName), semconv.ServiceVersion(version)),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to describe trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	return provider, provider.Shutdown, nil
+}
+
+// Router finds the pattern a request is routed by. http.ServeMux implements
+// it.
+type Router interface {
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+// RouteSpanName names the server span of a request after the pattern of
+// routes it matches, such as "GET /whoami", rather than after its path,
+// which the caller chooses freely. Requests that match no pattern are named
+// after their method alone.
+func RouteSpanName(routes Router) func(string, *http.Request) string {
+	return func(_ string, r *http.Request) string {
+		_, pattern := routes.Handler(r)
+		switch {
+		case pattern == "":
+			return r.Method
+		case strings.Contains(pattern, " "):
+			// The pattern already starts with a method
+			return pattern
+		default:
+			return r.Method + " " + pattern
+		}
+	}
+}
+
+// TraceAttrs returns the trace ID of the span in ctx, for correlating logs
+// with traces.
+func TraceAttrs(ctx context.Context) []slog.Attr {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return nil
+	}
+	return []slog.Attr{slog.String("trace_id", spanContext.TraceID().String())}
+}
+
+// TLSAttributes describes the TLS connection of a request or response.
+func TLSAttributes(state *tls.ConnectionState) []attribute.KeyValue {
+	if state == nil {
+		return nil
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("tls.protocol.version", tls.VersionName(state.Version)),
+		attribute.String("tls.cipher", tls.CipherSuiteName(state.CipherSuite)),
+		attribute.Bool("tls.resumed", state.DidResume),
+	}
+	if len(state.PeerCertificates) > 0 {
+		attrs = append(attrs, attribute.String("spiffe.peer_serial", state.PeerCertificates[0].SerialNumber.Text(16)))
+	}
+	return attrs
+}
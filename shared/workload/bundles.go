@@ -0,0 +1,70 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// X509Bundles keeps every X.509 bundle the Workload API hands out: the
+// workload's own trust domain and those it federates with. X509Source only
+// looks bundles up by trust domain, so it cannot list them.
+type X509Bundles struct {
+	client  *workloadapi.Client
+	cancel  context.CancelFunc
+	done    chan struct{}
+	current atomic.Pointer[x509bundle.Set]
+}
+
+// WatchX509Bundles keeps the bundles from the Workload API at addr up to date
+// until Close is called. Bundles is empty until the first update arrives.
+func WatchX509Bundles(ctx context.Context, addr string, logger *slog.Logger) (*X509Bundles, error) {
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(addr), workloadapi.WithLogger(Logger{logger}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Workload API client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b := &X509Bundles{client: client, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		client.WatchX509Bundles(ctx, bundleWatcher{bundles: b, logger: logger})
+	}()
+	return b, nil
+}
+
+// Bundles returns the current bundles, sorted by trust domain.
+func (b *X509Bundles) Bundles() []*x509bundle.Bundle {
+	set := b.current.Load()
+	if set == nil {
+		return nil
+	}
+	return set.Bundles()
+}
+
+// Close stops watching and closes the connection to the Workload API.
+func (b *X509Bundles) Close() error {
+	b.cancel()
+	<-b.done
+	return b.client.Close()
+}
+
+type bundleWatcher struct {
+	bundles *X509Bundles
+	logger  *slog.Logger
+}
+
+func (w bundleWatcher) OnX509BundlesUpdate(set *x509bundle.Set) {
+	w.bundles.current.Store(set)
+}
+
+func (w bundleWatcher) OnX509BundlesWatchError(err error) {
+	if !errors.Is(err, context.Canceled) {
+		w.logger.Warn("Failed to watch X.509 bundles", "error", err)
+	}
+}
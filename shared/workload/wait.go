@@ -0,0 +1,127 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons the Workload API is not ready yet, each with a hint at the usual
+// cause.
+var (
+	ErrSocketMissing      = errors.New("socket does not exist yet, is tbot running and the socket directory mounted?")
+	ErrConnectionRefused  = errors.New("socket refuses connections, tbot may still be starting")
+	ErrNoIdentityIssued   = errors.New("no identity issued, no workload identity matches this process yet")
+	ErrWorkloadAPITimeout = errors.New("no response in time")
+)
+
+// WaitConfig sets how long a service waits for the Workload API at startup,
+// so that a container started next to tbot does not crash-loop while tbot
+// comes up.
+type WaitConfig struct {
+	MaxWait        time.Duration `yaml:"max_wait"` // Give up after this long, 0 tries once
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// DefaultWaitConfig retries for a minute, backing off from a quarter second
+// up to five seconds.
+func DefaultWaitConfig() WaitConfig {
+	return WaitConfig{
+		MaxWait:        time.Minute,
+		InitialBackoff: 250 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+	}
+}
+
+// Validate checks that the backoff grows from a positive initial value.
+func (c WaitConfig) Validate() error {
+	switch {
+	case c.MaxWait < 0:
+		return fmt.Errorf("max_wait must not be negative, got %v", c.MaxWait)
+	case c.InitialBackoff <= 0 || c.MaxBackoff < c.InitialBackoff:
+		return fmt.Errorf("initial_backoff (%v) must be positive and not exceed max_backoff (%v)", c.InitialBackoff, c.MaxBackoff)
+	}
+	return nil
+}
+
+// Wait returns once the Workload API at addr issues an X509-SVID, retrying
+// with exponential backoff for up to config.MaxWait.
+func Wait(ctx context.Context, addr string, config WaitConfig) error {
+	deadline := time.Now().Add(config.MaxWait)
+	backoff := config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := Probe(ctx, addr)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("Workload API is ready", "addr", addr, "attempts", attempt)
+			}
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("workload API at %s not ready after %v: %w", addr, config.MaxWait, err)
+		}
+		wait := min(backoff, remaining)
+		slog.Warn("Workload API not ready, retrying", "addr", addr, "attempt", attempt,
+			"retry_in", wait.Truncate(time.Millisecond), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, config.MaxBackoff)
+	}
+}
+
+// Probe fetches an X509-SVID from addr once and classifies why it failed.
+func Probe(ctx context.Context, addr string) error {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if _, err := os.Stat(address); errors.Is(err, os.ErrNotExist) {
+			return ErrSocketMissing
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = workloadapi.FetchX509SVID(ctx, workloadapi.WithAddr(addr))
+	switch {
+	case err == nil:
+		return nil
+	case status.Code(err) == codes.PermissionDenied:
+		return ErrNoIdentityIssued
+	case status.Code(err) == codes.Unavailable:
+		return fmt.Errorf("%w: %v", ErrConnectionRefused, status.Convert(err).Message())
+	case status.Code(err) == codes.DeadlineExceeded, errors.Is(err, context.DeadlineExceeded):
+		return ErrWorkloadAPITimeout
+	default:
+		return err
+	}
+}
+
+// ParseWaitConfig overrides the maximum wait of config with the
+// <prefix>_WORKLOAD_API_WAIT variable.
+func ParseWaitConfig(prefix string, config *WaitConfig) error {
+	key := prefix + "_WORKLOAD_API_WAIT"
+	if value := os.Getenv(key); value != "" {
+		wait, err := time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		config.MaxWait = wait
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+const testID = "spiffe://example.com/backend"
+
+func TestProbe(t *testing.T) {
+	api := workloadtest.New(t, testID)
+	dir, err := os.MkdirTemp("", "startup")
+	if err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// A socket file nobody listens on any more
+	refusing := filepath.Join(dir, "refusing.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: refusing, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	testCases := []struct {
+		name     string
+		addr     string
+		expected error
+	}{
+		{"ready", api.Addr(testID), nil},
+		{"missing", "unix://" + filepath.Join(dir, "missing.sock"), ErrSocketMissing},
+		{"refusing", "unix://" + refusing, ErrConnectionRefused},
+		{"no_identity", api.NoIdentityAddr(), ErrNoIdentityIssued},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Probe(context.Background(), tc.addr); !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	api := workloadtest.New(t, testID)
+	dir, err := os.MkdirTemp("", "startup")
+	if err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "workload.sock")
+
+	config := WaitConfig{MaxWait: 100 * time.Millisecond, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	if err := Wait(context.Background(), "unix://"+socket, config); !errors.Is(err, ErrSocketMissing) {
+		t.Fatalf("Expected to give up on a missing socket, got %v", err)
+	}
+
+	// The socket shows up while waiting, as when tbot starts after the service
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Symlink(strings.TrimPrefix(api.Addr(testID), "unix://"), socket)
+	}()
+	config.MaxWait = 5 * time.Second
+	if err := Wait(context.Background(), "unix://"+socket, config); err != nil {
+		t.Errorf("Expected the Workload API to become ready, got %v", err)
+	}
+}
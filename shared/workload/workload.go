@@ -0,0 +1,109 @@
+// Package workload connects a service to the Workload API of tbot, resolving
+// the socket address, waiting for tbot to issue an identity and creating the
+// X.509 and JWT sources the service runs on.
+package workload
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// SocketFromEnv returns the Workload API address from the last of keys that
+// is set, so later keys take precedence, or "" if none is.
+func SocketFromEnv(keys ...string) string {
+	var addr string
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			addr = value
+		}
+	}
+	return addr
+}
+
+// ParseAddr splits a Workload API address such as unix:///run/spire.sock or
+// tcp://127.0.0.1:8081 into a network and address.
+func ParseAddr(addr string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid workload API address %q: %w", addr, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		// unix://relative/path parses its first segment as the host
+		return "unix", u.Host + u.Path, nil
+	case "tcp":
+		return "tcp", u.Host, nil
+	default:
+		return "", "", fmt.Errorf("invalid workload API address %q: scheme must be unix or tcp", addr)
+	}
+}
+
+// NewX509Source waits for the Workload API at addr as configured by wait and
+// returns a source that has received its first X509-SVID. The logs of
+// go-spiffe go to logger.
+func NewX509Source(ctx context.Context, addr string, wait WaitConfig, logger *slog.Logger) (*workloadapi.X509Source, error) {
+	slog.Info("Using Workload API socket", "addr", addr)
+
+	// tbot may still be starting, so wait for it to issue an identity
+	if err := Wait(ctx, addr, wait); err != nil {
+		return nil, err
+	}
+	source, err := workloadapi.NewX509Source(ctx,
+		workloadapi.WithClientOptions(workloadapi.WithAddr(addr), workloadapi.WithLogger(Logger{logger})))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create X509Source: %w", err)
+	}
+	if _, err := source.GetX509SVID(); err != nil {
+		source.Close()
+		return nil, fmt.Errorf("unable to get X509SVID: %w", err)
+	}
+	return source, nil
+}
+
+// NewJWTSource returns a source of JWT-SVIDs and JWT bundles from the
+// Workload API at addr.
+func NewJWTSource(ctx context.Context, addr string, logger *slog.Logger) (*workloadapi.JWTSource, error) {
+	source, err := workloadapi.NewJWTSource(ctx,
+		workloadapi.WithClientOptions(workloadapi.WithAddr(addr), workloadapi.WithLogger(Logger{logger})))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create JWTSource: %w", err)
+	}
+	return source, nil
+}
+
+// LogSVID logs msg with the identity and lifetime of svid.
+func LogSVID(msg string, svid *x509svid.SVID) {
+	slog.Info(msg,
+		"spiffe_id", svid.ID.String(),
+		"serial", svid.Certificates[0].SerialNumber.Text(16),
+		"not_after", svid.Certificates[0].NotAfter.Format(time.RFC3339),
+		"expires_in", time.Until(svid.Certificates[0].NotAfter).Truncate(time.Second))
+}
+
+// Logger passes the logs of go-spiffe on to slog at their level.
+type Logger struct {
+	Logger *slog.Logger
+}
+
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debug(fmt.Sprintf(format, args...), "component", "go-spiffe")
+}
+
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.Logger.Info(fmt.Sprintf(format, args...), "component", "go-spiffe")
+}
+
+func (l Logger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warn(fmt.Sprintf(format, args...), "component", "go-spiffe")
+}
+
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.Logger.Error(fmt.Sprintf(format, args...), "component", "go-spiffe")
+}
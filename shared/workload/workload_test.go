@@ -0,0 +1,89 @@
+package workload
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+)
+
+func TestParseAddr(t *testing.T) {
+	testCases := []struct {
+		addr, network, address string
+	}{
+		{"unix:///run/tbot/sockets/workload.sock", "unix", "/run/tbot/sockets/workload.sock"},
+		{"unix://testing/.cache/sockets/backend.sock", "unix", "testing/.cache/sockets/backend.sock"},
+		{"tcp://127.0.0.1:8081", "tcp", "127.0.0.1:8081"},
+	}
+	for _, tc := range testCases {
+		network, address, err := ParseAddr(tc.addr)
+		if err != nil || network != tc.network || address != tc.address {
+			t.Errorf("Expected %s %s for %s, got %s %s (%v)", tc.network, tc.address, tc.addr, network, address, err)
+		}
+	}
+	if _, _, err := ParseAddr("/run/workload.sock"); err == nil {
+		t.Error("Expected an address without scheme to be rejected")
+	}
+}
+
+func TestSocketFromEnv(t *testing.T) {
+	if addr := SocketFromEnv("TEST_SHARED_SOCKET", "TEST_OWN_SOCKET"); addr != "" {
+		t.Errorf("Expected no address, got %q", addr)
+	}
+	t.Setenv("TEST_SHARED_SOCKET", "unix:///run/shared.sock")
+	if addr := SocketFromEnv("TEST_SHARED_SOCKET", "TEST_OWN_SOCKET"); addr != "unix:///run/shared.sock" {
+		t.Errorf("Expected the shared socket, got %q", addr)
+	}
+	t.Setenv("TEST_OWN_SOCKET", "unix:///run/own.sock")
+	if addr := SocketFromEnv("TEST_SHARED_SOCKET", "TEST_OWN_SOCKET"); addr != "unix:///run/own.sock" {
+		t.Errorf("Expected the later key to take precedence, got %q", addr)
+	}
+}
+
+func TestNewX509Source(t *testing.T) {
+	api := workloadtest.New(t, testID)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	source, err := NewX509Source(ctx, api.Addr(testID), DefaultWaitConfig(), logger)
+	if err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	defer source.Close()
+	svid, err := source.GetX509SVID()
+	if err != nil || svid.ID.String() != testID {
+		t.Errorf("Expected an SVID for %s, got %v (%v)", testID, svid, err)
+	}
+
+	wait := WaitConfig{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if _, err := NewX509Source(ctx, api.NoIdentityAddr(), wait, logger); err == nil {
+		t.Error("Expected a Workload API without an identity to fail")
+	}
+}
+
+func TestWatchX509Bundles(t *testing.T) {
+	api := workloadtest.New(t, testID)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	bundles, err := WatchX509Bundles(context.Background(), api.Addr(testID), logger)
+	if err != nil {
+		t.Fatalf("Failed to watch bundles: %v", err)
+	}
+	defer bundles.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bundles.Bundles()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected bundles from the Workload API")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := bundles.Bundles()
+	if len(got) != 1 || got[0].TrustDomain().String() != "example.com" || len(got[0].X509Authorities()) != 1 {
+		t.Errorf("Expected the example.com bundle with one authority, got %v", got)
+	}
+}
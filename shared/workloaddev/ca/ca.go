@@ -0,0 +1,301 @@
+// Package ca implements the in-memory certificate authority of the local
+// development Workload API. It issues X509-SVIDs and JWT-SVIDs for a single
+// trust domain from keys that never leave the process.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// DefaultCATTL is the lifetime of a generated root certificate.
+const DefaultCATTL = 24 * time.Hour
+
+// backdate is subtracted from NotBefore to tolerate small clock skew.
+const backdate = 10 * time.Second
+
+// authority is one generation of signing keys.
+type authority struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	jwtKey crypto.Signer
+	jwtKID string
+}
+
+// CA is an in-memory SPIFFE certificate authority for one trust domain. The
+// root can be rotated; SVIDs are always signed by the newest root, and the
+// bundles keep the previous root so that SVIDs issued before a rotation
+// stay valid until they expire.
+type CA struct {
+	td    spiffeid.TrustDomain
+	ttl   time.Duration
+	clock func() time.Time
+
+	mu       sync.RWMutex
+	current  *authority
+	previous *authority
+}
+
+// Option configures a CA.
+type Option func(*CA)
+
+// WithTTL sets the lifetime of the root certificate.
+func WithTTL(ttl time.Duration) Option {
+	return func(ca *CA) { ca.ttl = ttl }
+}
+
+// WithClock overrides the time source, mostly for tests.
+func WithClock(clock func() time.Time) Option {
+	return func(ca *CA) { ca.clock = clock }
+}
+
+// New creates a CA for td with a freshly generated root.
+func New(td spiffeid.TrustDomain, opts ...Option) (*CA, error) {
+	ca := &CA{td: td, ttl: DefaultCATTL, clock: time.Now}
+	for _, opt := range opts {
+		opt(ca)
+	}
+
+	current, err := ca.newAuthority()
+	if err != nil {
+		return nil, err
+	}
+	ca.current = current
+	return ca, nil
+}
+
+// TrustDomain returns the trust domain of the CA.
+func (ca *CA) TrustDomain() spiffeid.TrustDomain {
+	return ca.td
+}
+
+func (ca *CA) newAuthority() (*authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate CA key: %w", err)
+	}
+	jwtKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate JWT signing key: %w", err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := ca.clock()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"SPIFFE dev"}, CommonName: ca.td.String()},
+		URIs:                  []*url.URL{ca.td.ID().URL()},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(ca.ttl),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := keyID(jwtKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &authority{cert: cert, key: key, jwtKey: jwtKey, jwtKID: kid}, nil
+}
+
+// Rotate replaces the root and JWT signing key. The previous generation is
+// kept in the bundles until the next rotation.
+func (ca *CA) Rotate() error {
+	next, err := ca.newAuthority()
+	if err != nil {
+		return err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.previous = ca.current
+	ca.current = next
+	return nil
+}
+
+// X509Bundle returns the roots trusted for the trust domain.
+func (ca *CA) X509Bundle() *x509bundle.Bundle {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	bundle := x509bundle.New(ca.td)
+	bundle.AddX509Authority(ca.current.cert)
+	if ca.previous != nil {
+		bundle.AddX509Authority(ca.previous.cert)
+	}
+	return bundle
+}
+
+// JWTBundle returns the JWT authorities of the trust domain.
+func (ca *CA) JWTBundle() *jwtbundle.Bundle {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	bundle := jwtbundle.New(ca.td)
+	// Keys are generated by newAuthority, adding them cannot fail
+	_ = bundle.AddJWTAuthority(ca.current.jwtKID, ca.current.jwtKey.Public())
+	if ca.previous != nil {
+		_ = bundle.AddJWTAuthority(ca.previous.jwtKID, ca.previous.jwtKey.Public())
+	}
+	return bundle
+}
+
+// X509SVIDParams describes an X509-SVID to issue.
+type X509SVIDParams struct {
+	ID spiffeid.ID
+	// TTL is the requested lifetime. It is capped at the root's expiry.
+	TTL time.Duration
+	// NotBefore overrides the start of the validity period, which defaults to
+	// now. Together with TTL it allows issuing already expired SVIDs.
+	NotBefore time.Time
+}
+
+// IssueX509SVID issues an X509-SVID with a new private key.
+func (ca *CA) IssueX509SVID(params X509SVIDParams) (*x509svid.SVID, error) {
+	if !params.ID.MemberOf(ca.td) {
+		return nil, fmt.Errorf("SPIFFE ID %q is not a member of trust domain %q", params.ID, ca.td)
+	}
+	if params.TTL <= 0 {
+		return nil, errors.New("X509-SVID TTL must be positive")
+	}
+
+	ca.mu.RLock()
+	signer := ca.current
+	ca.mu.RUnlock()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate SVID key: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := params.NotBefore
+	if notBefore.IsZero() {
+		notBefore = ca.clock().Add(-backdate)
+	}
+	notAfter := notBefore.Add(params.TTL)
+	if notAfter.After(signer.cert.NotAfter) {
+		notAfter = signer.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"SPIFFE dev"}, SerialNumber: serial.String()},
+		URIs:                  []*url.URL{params.ID.URL()},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, key.Public(), signer.key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create X509-SVID: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &x509svid.SVID{
+		ID:           params.ID,
+		Certificates: []*x509.Certificate{cert},
+		PrivateKey:   key,
+	}, nil
+}
+
+// JWTSVIDParams describes a JWT-SVID to issue.
+type JWTSVIDParams struct {
+	ID       spiffeid.ID
+	Audience []string
+	TTL      time.Duration
+}
+
+// IssueJWTSVID issues a signed JWT-SVID.
+func (ca *CA) IssueJWTSVID(params JWTSVIDParams) (*jwtsvid.SVID, error) {
+	if !params.ID.MemberOf(ca.td) {
+		return nil, fmt.Errorf("SPIFFE ID %q is not a member of trust domain %q", params.ID, ca.td)
+	}
+	if len(params.Audience) == 0 {
+		return nil, errors.New("JWT-SVID audience is required")
+	}
+	if params.TTL <= 0 {
+		return nil, errors.New("JWT-SVID TTL must be positive")
+	}
+
+	ca.mu.RLock()
+	signer := ca.current
+	ca.mu.RUnlock()
+
+	joseSigner, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: signer.jwtKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", signer.jwtKID))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create JWT signer: %w", err)
+	}
+
+	now := ca.clock()
+	token, err := jwt.Signed(joseSigner).Claims(jwt.Claims{
+		Subject:  params.ID.String(),
+		Audience: params.Audience,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(params.TTL)),
+	}).Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign JWT-SVID: %w", err)
+	}
+	return jwtsvid.ParseInsecure(token, params.Audience)
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// keyID derives a stable key ID from the public key.
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:16]), nil
+}
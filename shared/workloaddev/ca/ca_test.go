@@ -0,0 +1,117 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+var td = spiffeid.RequireTrustDomainFromString("example.com")
+
+func TestIssueX509SVID(t *testing.T) {
+	authority, err := New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+
+	id := spiffeid.RequireFromPath(td, "/backend")
+	svid, err := authority.IssueX509SVID(X509SVIDParams{ID: id, TTL: 5 * time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to issue X509-SVID: %v", err)
+	}
+
+	verifiedID, _, err := x509svid.Verify(svid.Certificates, authority.X509Bundle())
+	if err != nil {
+		t.Fatalf("Issued SVID does not verify against the bundle: %v", err)
+	}
+	if verifiedID != id {
+		t.Errorf("Expected %s, got %s", id, verifiedID)
+	}
+
+	lifetime := time.Until(svid.Certificates[0].NotAfter)
+	if lifetime > 5*time.Minute || lifetime < 4*time.Minute {
+		t.Errorf("Expected lifetime around 5m, got %v", lifetime)
+	}
+
+	if _, err := authority.IssueX509SVID(X509SVIDParams{
+		ID:  spiffeid.RequireFromString("spiffe://other.org/web"),
+		TTL: time.Minute,
+	}); err == nil {
+		t.Error("Expected SVIDs outside the trust domain to be refused")
+	}
+}
+
+func TestIssueX509SVIDCappedAtCAExpiry(t *testing.T) {
+	authority, err := New(td, WithTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	svid, err := authority.IssueX509SVID(X509SVIDParams{ID: spiffeid.RequireFromPath(td, "/web"), TTL: 48 * time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to issue X509-SVID: %v", err)
+	}
+	if svid.Certificates[0].NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected SVID to expire with the CA, got %v", svid.Certificates[0].NotAfter)
+	}
+}
+
+func TestRotateKeepsPreviousRoot(t *testing.T) {
+	authority, err := New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	id := spiffeid.RequireFromPath(td, "/web")
+	before, err := authority.IssueX509SVID(X509SVIDParams{ID: id, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to issue X509-SVID: %v", err)
+	}
+
+	if err := authority.Rotate(); err != nil {
+		t.Fatalf("Failed to rotate CA: %v", err)
+	}
+	after, err := authority.IssueX509SVID(X509SVIDParams{ID: id, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to issue X509-SVID: %v", err)
+	}
+
+	if before.Certificates[0].AuthorityKeyId == nil ||
+		string(before.Certificates[0].AuthorityKeyId) == string(after.Certificates[0].AuthorityKeyId) {
+		t.Error("Expected SVIDs to be signed by the new root after rotation")
+	}
+	for _, svid := range []*x509svid.SVID{before, after} {
+		if _, _, err := x509svid.Verify(svid.Certificates, authority.X509Bundle()); err != nil {
+			t.Errorf("Expected SVID %x to verify after rotation: %v", svid.Certificates[0].SerialNumber, err)
+		}
+	}
+	if n := len(authority.X509Bundle().X509Authorities()); n != 2 {
+		t.Errorf("Expected 2 roots in the bundle, got %d", n)
+	}
+}
+
+func TestIssueJWTSVID(t *testing.T) {
+	authority, err := New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+
+	id := spiffeid.RequireFromPath(td, "/web")
+	svid, err := authority.IssueJWTSVID(JWTSVIDParams{ID: id, Audience: []string{"backend"}, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to issue JWT-SVID: %v", err)
+	}
+
+	validated, err := jwtsvid.ParseAndValidate(svid.Marshal(), authority.JWTBundle(), []string{"backend"})
+	if err != nil {
+		t.Fatalf("Issued JWT-SVID does not validate: %v", err)
+	}
+	if validated.ID != id {
+		t.Errorf("Expected %s, got %s", id, validated.ID)
+	}
+
+	if _, err := jwtsvid.ParseAndValidate(svid.Marshal(), authority.JWTBundle(), []string{"other"}); err == nil {
+		t.Error("Expected JWT-SVID to be rejected for another audience")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Caller describes the process on the other end of a Workload API
+// connection, as far as the operating system tells us.
+type Caller struct {
+	// Socket is the absolute path of the socket the caller connected to.
+	Socket string
+	// HasCredentials reports whether the fields below are known.
+	HasCredentials bool
+	PID            int32
+	UID            uint32
+	GID            uint32
+	// Path is the absolute path of the caller's executable, if readable.
+	Path string
+}
+
+// AuthType implements credentials.AuthInfo.
+func (Caller) AuthType() string {
+	return "peercred"
+}
+
+// peerCredentials is a gRPC transport credential that does not secure the
+// connection (it is a local unix socket) but records who is calling.
+type peerCredentials struct{}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	caller := Caller{Socket: socketPath(conn.LocalAddr())}
+	readPeerCredentials(conn, &caller)
+	return conn, caller, nil
+}
+
+func (peerCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, Caller{}, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+func socketPath(addr net.Addr) string {
+	if addr == nil || addr.Network() != "unix" {
+		return ""
+	}
+	if path, err := filepath.Abs(addr.String()); err == nil {
+		return path
+	}
+	return addr.String()
+}
+
+func callerFromContext(ctx context.Context) Caller {
+	if p, ok := peer.FromContext(ctx); ok {
+		if caller, ok := p.AuthInfo.(Caller); ok {
+			return caller
+		}
+	}
+	return Caller{}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// State is the current simulation state of the server, changed through the
+// control methods below.
+type State struct {
+	// X509SVIDTTL is the lifetime of issued X509-SVIDs.
+	X509SVIDTTL time.Duration
+	// Expired reports whether X509-SVIDs are issued already expired.
+	Expired bool
+	// Paused reports whether the server has stopped responding.
+	Paused bool
+}
+
+// State returns the current simulation state.
+func (s *Server) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return State{X509SVIDTTL: s.currentX509TTL(), Expired: s.expired, Paused: s.paused}
+}
+
+// RotateSVIDs pushes freshly issued X509-SVIDs to every connected workload
+// immediately instead of waiting for half of their lifetime.
+func (s *Server) RotateSVIDs() {
+	s.notify()
+}
+
+// RotateCA rotates the root and JWT signing key and pushes the new bundles
+// and SVIDs signed by the new root to every connected workload.
+func (s *Server) RotateCA() error {
+	if err := s.ca.Rotate(); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// SetX509SVIDTTL overrides the lifetime of X509-SVIDs issued from now on, to
+// simulate short-lived credentials. Zero restores the configured lifetime.
+// Connected workloads receive an SVID with the new lifetime immediately.
+func (s *Server) SetX509SVIDTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.x509TTLOverride = max(ttl, 0)
+	s.mu.Unlock()
+	s.notify()
+}
+
+// SetExpired makes the server issue X509-SVIDs whose validity period has
+// already ended. Connected workloads receive one immediately.
+func (s *Server) SetExpired(expired bool) {
+	s.mu.Lock()
+	s.expired = expired
+	s.mu.Unlock()
+	s.notify()
+}
+
+// SetPaused stops the server from responding: RPCs block and streams send no
+// updates until it is resumed, like an agent that hangs.
+func (s *Server) SetPaused(paused bool) {
+	s.mu.Lock()
+	s.paused = paused
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Reset restores the configured lifetime and resumes normal issuance.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.x509TTLOverride = 0
+	s.expired = false
+	s.paused = false
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Server) currentX509TTL() time.Duration {
+	if s.x509TTLOverride > 0 {
+		return s.x509TTLOverride
+	}
+	return s.x509TTL
+}
+
+// changes returns a channel that is closed on the next state change.
+func (s *Server) changes() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// notify wakes everyone waiting on changes.
+func (s *Server) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitResumed blocks while the server is paused.
+func (s *Server) waitResumed(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		paused, changed := s.paused, s.changed
+		s.mu.Unlock()
+		if !paused {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+func TestControls(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.com")
+	authority, err := ca.New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	backendID := spiffeid.RequireFromPath(td, "/backend")
+	srv, addrs := startServer(t, authority, func(map[string]string) []Entry {
+		return []Entry{{SPIFFEID: backendID}}
+	}, "backend")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(addrs["backend"])))
+	if err != nil {
+		t.Fatalf("Failed to create X509 source: %v", err)
+	}
+	defer source.Close()
+
+	// next applies change and returns the SVID the source receives next
+	next := func(change func()) *x509svid.SVID {
+		t.Helper()
+		updated := source.Updated()
+		change()
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for an SVID update")
+		}
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			t.Fatalf("Failed to get X509-SVID: %v", err)
+		}
+		return svid
+	}
+
+	initial, _ := source.GetX509SVID()
+	rotated := next(srv.RotateSVIDs)
+	if rotated.Certificates[0].SerialNumber.Cmp(initial.Certificates[0].SerialNumber) == 0 {
+		t.Error("Expected a new X509-SVID after RotateSVIDs")
+	}
+
+	short := next(func() { srv.SetX509SVIDTTL(30 * time.Second) })
+	if lifetime := time.Until(short.Certificates[0].NotAfter); lifetime > 30*time.Second {
+		t.Errorf("Expected a short-lived X509-SVID, expires in %v", lifetime)
+	}
+
+	expired := next(func() { srv.SetExpired(true) })
+	if !expired.Certificates[0].NotAfter.Before(time.Now()) {
+		t.Errorf("Expected an expired X509-SVID, expires at %v", expired.Certificates[0].NotAfter)
+	}
+
+	srv.Reset()
+	if state := srv.State(); state != (State{X509SVIDTTL: 10 * time.Minute}) {
+		t.Errorf("Expected reset state, got %+v", state)
+	}
+
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(addrs["backend"]))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	oldRoot := authority.X509Bundle().X509Authorities()[0]
+	if err := srv.RotateCA(); err != nil {
+		t.Fatalf("Failed to rotate CA: %v", err)
+	}
+	// Wait for the SVID signed by the new root
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		svid, _ := source.GetX509SVID()
+		if svid.Certificates[0].CheckSignatureFrom(oldRoot) != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected an X509-SVID signed by the rotated CA")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bundles, err := client.FetchX509Bundles(ctx)
+	if err != nil {
+		t.Fatalf("Failed to fetch X509 bundles: %v", err)
+	}
+	if bundle, _ := bundles.GetX509BundleForTrustDomain(td); bundle == nil || len(bundle.X509Authorities()) != 2 {
+		t.Errorf("Expected the bundle to keep the previous root after rotation, got %v", bundle)
+	}
+
+	// A paused server does not respond until it is resumed
+	srv.SetPaused(true)
+	pausedCtx, pausedCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer pausedCancel()
+	if _, err := client.FetchJWTSVID(pausedCtx, jwtsvid.Params{Audience: "web"}); !errors.Is(pausedCtx.Err(), context.DeadlineExceeded) || err == nil {
+		t.Errorf("Expected a paused server not to respond, got %v", err)
+	}
+	srv.SetPaused(false)
+	if _, err := client.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "web"}); err != nil {
+		t.Errorf("Expected a resumed server to respond, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"path/filepath"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Entry grants a SPIFFE ID to every caller matching all of its selectors.
+// An entry without selectors matches every caller.
+type Entry struct {
+	SPIFFEID  spiffeid.ID
+	Selectors Selectors
+}
+
+// Selectors identify callers. Empty fields are ignored.
+type Selectors struct {
+	// Socket matches the absolute path of the socket the caller used.
+	Socket string
+	// UID and GID match the caller's user and group.
+	UID *uint32
+	GID *uint32
+	// Binary matches the base name of the caller's executable.
+	Binary string
+	// Path matches the absolute path of the caller's executable.
+	Path string
+}
+
+// Matches reports whether caller satisfies every selector.
+func (s Selectors) Matches(caller Caller) bool {
+	if s.Socket != "" && s.Socket != caller.Socket {
+		return false
+	}
+
+	needsCredentials := s.UID != nil || s.GID != nil || s.Binary != "" || s.Path != ""
+	if needsCredentials && !caller.HasCredentials {
+		return false
+	}
+	if s.UID != nil && *s.UID != caller.UID {
+		return false
+	}
+	if s.GID != nil && *s.GID != caller.GID {
+		return false
+	}
+	if s.Binary != "" && s.Binary != filepath.Base(caller.Path) {
+		return false
+	}
+	if s.Path != "" && s.Path != caller.Path {
+		return false
+	}
+	return true
+}
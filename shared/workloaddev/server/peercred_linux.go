@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPeerCredentials fills in the caller's pid, uid, gid and executable
+// using SO_PEERCRED.
+func readPeerCredentials(conn net.Conn, caller *Caller) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return
+	}
+
+	caller.HasCredentials = true
+	caller.PID = cred.Pid
+	caller.UID = cred.Uid
+	caller.GID = cred.Gid
+	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.Pid)); err == nil {
+		caller.Path = path
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+func TestPeerCredentialSelectors(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.com")
+	authority, err := ca.New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to get executable: %v", err)
+	}
+	uid := uint32(os.Getuid())
+	testID := spiffeid.RequireFromPath(td, "/test-binary")
+
+	_, addrs := startServer(t, authority, func(map[string]string) []Entry {
+		return []Entry{
+			{SPIFFEID: spiffeid.RequireFromPath(td, "/other-binary"), Selectors: Selectors{Binary: "not-this-test"}},
+			{SPIFFEID: testID, Selectors: Selectors{UID: &uid, Binary: filepath.Base(exe)}},
+		}
+	}, "shared")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	svid, err := workloadapi.FetchX509SVID(ctx, workloadapi.WithAddr(addrs["shared"]))
+	if err != nil {
+		t.Fatalf("Failed to fetch X509-SVID: %v", err)
+	}
+	if svid.ID != testID {
+		t.Errorf("Expected %s from peer credentials, got %s", testID, svid.ID)
+	}
+}
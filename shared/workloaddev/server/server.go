@@ -0,0 +1,361 @@
+// Package server implements the SPIFFE Workload API on top of the in-memory
+// CA, so that go-spiffe clients can run without a SPIRE agent or tbot.
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Default SVID lifetimes, matching the short-lived credentials tbot issues.
+const (
+	DefaultX509SVIDTTL = time.Hour
+	DefaultJWTSVIDTTL  = 5 * time.Minute
+)
+
+// Config configures a Server.
+type Config struct {
+	CA      *ca.CA
+	Entries []Entry
+	// X509SVIDTTL and JWTSVIDTTL default to DefaultX509SVIDTTL and
+	// DefaultJWTSVIDTTL.
+	X509SVIDTTL time.Duration
+	JWTSVIDTTL  time.Duration
+}
+
+// Server serves the Workload API. X509-SVIDs are re-issued to connected
+// workloads when half of their lifetime has passed, like a real agent does,
+// or immediately when the state is changed through the control methods.
+type Server struct {
+	// WIT-SVIDs are not issued, their methods answer Unimplemented
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	ca      *ca.CA
+	entries []Entry
+	x509TTL time.Duration
+	jwtTTL  time.Duration
+
+	mu              sync.Mutex
+	changed         chan struct{}
+	x509TTLOverride time.Duration
+	expired         bool
+	paused          bool
+
+	grpc *grpc.Server
+}
+
+// New creates a Server. Call Serve for every listener.
+func New(config Config) (*Server, error) {
+	if config.CA == nil {
+		return nil, errors.New("a CA is required")
+	}
+	for _, entry := range config.Entries {
+		if !entry.SPIFFEID.MemberOf(config.CA.TrustDomain()) {
+			return nil, fmt.Errorf("SPIFFE ID %q is not a member of trust domain %q", entry.SPIFFEID, config.CA.TrustDomain())
+		}
+	}
+
+	s := &Server{
+		ca:      config.CA,
+		entries: config.Entries,
+		x509TTL: config.X509SVIDTTL,
+		jwtTTL:  config.JWTSVIDTTL,
+		changed: make(chan struct{}),
+	}
+	if s.x509TTL <= 0 {
+		s.x509TTL = DefaultX509SVIDTTL
+	}
+	if s.jwtTTL <= 0 {
+		s.jwtTTL = DefaultJWTSVIDTTL
+	}
+
+	s.grpc = grpc.NewServer(grpc.Creds(peerCredentials{}))
+	workload.RegisterSpiffeWorkloadAPIServer(s.grpc, s)
+	return s, nil
+}
+
+// Listen creates a unix socket listener for addr, which may be a plain path
+// or a unix:// URI. A stale socket file is removed first.
+func Listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix://")
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Workloads in other containers sharing the socket volume may run as a
+	// different user; this is a development tool.
+	if err := os.Chmod(path, 0o777); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accepts Workload API connections on listener until Stop is called.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.grpc.Serve(listener)
+}
+
+// Stop closes all listeners and connections.
+func (s *Server) Stop() {
+	s.grpc.Stop()
+}
+
+// entriesFor returns the entries granted to the caller of ctx after checking
+// the Workload API security header. It blocks while the server is paused.
+func (s *Server) entriesFor(ctx context.Context) (Caller, []Entry, error) {
+	if err := s.waitResumed(ctx); err != nil {
+		return Caller{}, nil, status.FromContextError(err).Err()
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return Caller{}, nil, status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+
+	caller := callerFromContext(ctx)
+	var entries []Entry
+	for _, entry := range s.entries {
+		if entry.Selectors.Matches(caller) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		log.Printf("No identity for caller %s", describeCaller(caller))
+		return caller, nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	return caller, entries, nil
+}
+
+// FetchX509SVID streams X509-SVIDs for every entry of the caller, issuing new
+// ones when half of their lifetime has passed or the state changes.
+func (s *Server) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	ctx := stream.Context()
+	caller, entries, err := s.entriesFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := s.waitResumed(ctx); err != nil {
+			return nil
+		}
+		changed := s.changes()
+		resp, refresh, err := s.x509SVIDResponse(entries)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		log.Printf("Issued X509-SVID %s to %s (refresh in %v)", entries[0].SPIFFEID, describeCaller(caller), refresh)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-time.After(refresh):
+		}
+	}
+}
+
+func (s *Server) x509SVIDResponse(entries []Entry) (*workload.X509SVIDResponse, time.Duration, error) {
+	state := s.State()
+	bundle := concatDER(s.ca.X509Bundle().X509Authorities())
+	resp := &workload.X509SVIDResponse{}
+	refresh := state.X509SVIDTTL / 2
+
+	params := ca.X509SVIDParams{TTL: state.X509SVIDTTL}
+	if state.Expired {
+		// Ended a minute ago, so that it is rejected despite clock skew
+		params.NotBefore = time.Now().Add(-state.X509SVIDTTL - time.Minute)
+	}
+	for _, entry := range entries {
+		params.ID = entry.SPIFFEID
+		svid, err := s.ca.IssueX509SVID(params)
+		if err != nil {
+			return nil, 0, err
+		}
+		certs, key, err := svid.MarshalRaw()
+		if err != nil {
+			return nil, 0, err
+		}
+		resp.Svids = append(resp.Svids, &workload.X509SVID{
+			SpiffeId:    svid.ID.String(),
+			X509Svid:    certs,
+			X509SvidKey: key,
+			Bundle:      bundle,
+		})
+		if lifetime := time.Until(svid.Certificates[0].NotAfter) / 2; !state.Expired && lifetime < refresh {
+			refresh = lifetime
+		}
+	}
+	if refresh < time.Second {
+		refresh = time.Second
+	}
+	return resp, refresh, nil
+}
+
+// FetchX509Bundles streams the X.509 bundle of the trust domain, sending it
+// again whenever the state changes.
+func (s *Server) FetchX509Bundles(_ *workload.X509BundlesRequest, stream workload.SpiffeWorkloadAPI_FetchX509BundlesServer) error {
+	ctx := stream.Context()
+	if _, _, err := s.entriesFor(ctx); err != nil {
+		return err
+	}
+
+	for {
+		if err := s.waitResumed(ctx); err != nil {
+			return nil
+		}
+		changed := s.changes()
+		bundle := s.ca.X509Bundle()
+		if err := stream.Send(&workload.X509BundlesResponse{
+			Bundles: map[string][]byte{bundle.TrustDomain().IDString(): concatDER(bundle.X509Authorities())},
+		}); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// FetchJWTSVID issues JWT-SVIDs for the requested audience.
+func (s *Server) FetchJWTSVID(ctx context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	caller, entries, err := s.entriesFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Audience) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+
+	resp := &workload.JWTSVIDResponse{}
+	for _, entry := range entries {
+		if req.SpiffeId != "" && req.SpiffeId != entry.SPIFFEID.String() {
+			continue
+		}
+		svid, err := s.ca.IssueJWTSVID(ca.JWTSVIDParams{ID: entry.SPIFFEID, Audience: req.Audience, TTL: s.jwtTTL})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Svids = append(resp.Svids, &workload.JWTSVID{SpiffeId: svid.ID.String(), Svid: svid.Marshal()})
+	}
+	if len(resp.Svids) == 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "no identity issued for %q", req.SpiffeId)
+	}
+	log.Printf("Issued JWT-SVID %s for audience %v to %s", resp.Svids[0].SpiffeId, req.Audience, describeCaller(caller))
+	return resp, nil
+}
+
+// FetchJWTBundles streams the JWT bundle of the trust domain, sending it again
+// whenever the state changes.
+func (s *Server) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	ctx := stream.Context()
+	if _, _, err := s.entriesFor(ctx); err != nil {
+		return err
+	}
+
+	for {
+		if err := s.waitResumed(ctx); err != nil {
+			return nil
+		}
+		changed := s.changes()
+		resp, err := s.jwtBundlesResponse()
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+func (s *Server) jwtBundlesResponse() (*workload.JWTBundlesResponse, error) {
+	bundle := s.ca.JWTBundle()
+	jwks, err := bundle.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &workload.JWTBundlesResponse{
+		Bundles: map[string][]byte{bundle.TrustDomain().IDString(): jwks},
+	}, nil
+}
+
+// ValidateJWTSVID validates a JWT-SVID against the trust domain's JWT bundle.
+func (s *Server) ValidateJWTSVID(ctx context.Context, req *workload.ValidateJWTSVIDRequest) (*workload.ValidateJWTSVIDResponse, error) {
+	if _, _, err := s.entriesFor(ctx); err != nil {
+		return nil, err
+	}
+	if req.Audience == "" {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+	if req.Svid == "" {
+		return nil, status.Error(codes.InvalidArgument, "svid must be specified")
+	}
+
+	svid, err := jwtsvid.ParseAndValidate(req.Svid, s.ca.JWTBundle(), []string{req.Audience})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	claims, err := structpb.NewStruct(svid.Claims)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &workload.ValidateJWTSVIDResponse{SpiffeId: svid.ID.String(), Claims: claims}, nil
+}
+
+func concatDER(certs []*x509.Certificate) []byte {
+	var der []byte
+	for _, cert := range certs {
+		der = append(der, cert.Raw...)
+	}
+	return der
+}
+
+func describeCaller(caller Caller) string {
+	if !caller.HasCredentials {
+		return fmt.Sprintf("socket=%s", caller.Socket)
+	}
+	return fmt.Sprintf("socket=%s pid=%d uid=%d gid=%d path=%s",
+		caller.Socket, caller.PID, caller.UID, caller.GID, caller.Path)
+}
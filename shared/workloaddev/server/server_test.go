@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// startServer serves entries on one socket per name and returns the server
+// and the socket addresses by name.
+func startServer(t *testing.T, authority *ca.CA, entries func(sockets map[string]string) []Entry, names ...string) (*Server, map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	sockets := map[string]string{}
+	for _, name := range names {
+		sockets[name] = filepath.Join(dir, name+".sock")
+	}
+
+	srv, err := New(Config{CA: authority, Entries: entries(sockets), X509SVIDTTL: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(srv.Stop)
+
+	addrs := map[string]string{}
+	for name, path := range sockets {
+		listener, err := Listen(path)
+		if err != nil {
+			t.Fatalf("Failed to listen on %s: %v", path, err)
+		}
+		go srv.Serve(listener)
+		addrs[name] = "unix://" + path
+	}
+	return srv, addrs
+}
+
+func TestWorkloadAPI(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.com")
+	authority, err := ca.New(td)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	backendID := spiffeid.RequireFromPath(td, "/backend")
+
+	_, addrs := startServer(t, authority, func(sockets map[string]string) []Entry {
+		return []Entry{{SPIFFEID: backendID, Selectors: Selectors{Socket: sockets["backend"]}}}
+	}, "backend", "unknown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(addrs["backend"]))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	svid, err := client.FetchX509SVID(ctx)
+	if err != nil {
+		t.Fatalf("Failed to fetch X509-SVID: %v", err)
+	}
+	if svid.ID != backendID {
+		t.Errorf("Expected %s, got %s", backendID, svid.ID)
+	}
+	if _, _, err := x509svid.Verify(svid.Certificates, authority.X509Bundle()); err != nil {
+		t.Errorf("Fetched X509-SVID does not verify: %v", err)
+	}
+
+	jwtSVID, err := client.FetchJWTSVID(ctx, jwtsvid.Params{Audience: "web"})
+	if err != nil {
+		t.Fatalf("Failed to fetch JWT-SVID: %v", err)
+	}
+	bundles, err := client.FetchJWTBundles(ctx)
+	if err != nil {
+		t.Fatalf("Failed to fetch JWT bundles: %v", err)
+	}
+	if _, err := jwtsvid.ParseAndValidate(jwtSVID.Marshal(), bundles, []string{"web"}); err != nil {
+		t.Errorf("Fetched JWT-SVID does not validate against fetched bundles: %v", err)
+	}
+	if validated, err := client.ValidateJWTSVID(ctx, jwtSVID.Marshal(), "web"); err != nil || validated.ID != backendID {
+		t.Errorf("Expected server side validation to succeed for %s, got %v", backendID, err)
+	}
+
+	// A caller on a socket without entries gets no identity
+	unknown, err := workloadapi.New(ctx, workloadapi.WithAddr(addrs["unknown"]))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer unknown.Close()
+	if _, err := unknown.FetchX509SVID(ctx); err == nil || !strings.Contains(err.Error(), "no identity issued") {
+		t.Errorf("Expected no identity issued, got %v", err)
+	}
+}
+
+func TestSelectorsMatch(t *testing.T) {
+	uid := uint32(1000)
+	caller := Caller{Socket: "/run/a.sock", HasCredentials: true, UID: 1000, GID: 1000, Path: "/usr/local/bin/backend"}
+
+	testCases := []struct {
+		name      string
+		selectors Selectors
+		caller    Caller
+		expected  bool
+	}{
+		{"empty", Selectors{}, caller, true},
+		{"socket", Selectors{Socket: "/run/a.sock"}, caller, true},
+		{"other_socket", Selectors{Socket: "/run/b.sock"}, caller, false},
+		{"uid_and_binary", Selectors{UID: &uid, Binary: "backend"}, caller, true},
+		{"other_binary", Selectors{Binary: "web-go"}, caller, false},
+		{"path", Selectors{Path: "/usr/local/bin/backend"}, caller, true},
+		{"no_credentials", Selectors{UID: &uid}, Caller{Socket: "/run/a.sock"}, false},
+	}
+	for _, tc := range testCases {
+		if got := tc.selectors.Matches(tc.caller); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
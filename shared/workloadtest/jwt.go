@@ -0,0 +1,60 @@
+package workloadtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// JWTIssuer signs JWT-SVIDs with arbitrary claims, such as expired ones or
+// ones for another audience, which the Workload API would never issue.
+type JWTIssuer struct {
+	t      testing.TB
+	bundle *jwtbundle.Bundle
+	signer jose.Signer
+}
+
+// NewJWTIssuer creates an issuer with a fresh key for trustDomain.
+func NewJWTIssuer(t testing.TB, trustDomain string) *JWTIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("workloadtest: unable to generate key: %v", err)
+	}
+	bundle := jwtbundle.New(spiffeid.RequireTrustDomainFromString(trustDomain))
+	if err := bundle.AddJWTAuthority("test-key", key.Public()); err != nil {
+		t.Fatalf("workloadtest: unable to add JWT authority: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test-key"))
+	if err != nil {
+		t.Fatalf("workloadtest: unable to create signer: %v", err)
+	}
+	return &JWTIssuer{t: t, bundle: bundle, signer: signer}
+}
+
+// Bundle returns the JWT bundle that verifies the tokens of the issuer.
+func (i *JWTIssuer) Bundle() *jwtbundle.Bundle {
+	return i.bundle
+}
+
+// Sign returns a JWT-SVID for subject and audience that expires at expiry.
+func (i *JWTIssuer) Sign(subject string, audience []string, expiry time.Time) string {
+	i.t.Helper()
+	token, err := jwt.Signed(i.signer).Claims(jwt.Claims{
+		Subject:  subject,
+		Audience: audience,
+		Expiry:   jwt.NewNumericDate(expiry),
+	}).Serialize()
+	if err != nil {
+		i.t.Fatalf("workloadtest: unable to sign token: %v", err)
+	}
+	return token
+}
@@ -0,0 +1,122 @@
+// Package workloadtest starts an in-process Workload API backed by a test CA,
+// so that tests can run real workloads against it and exercise real SVID
+// fetching, mTLS handshakes, authorization denials and rotation.
+//
+//	api := workloadtest.New(t, "spiffe://example.com/backend", "spiffe://example.com/web")
+//	t.Setenv("WORKLOAD_API_SOCKET", api.Addr("spiffe://example.com/backend"))
+//	web := api.X509Source(t, "spiffe://example.com/web")
+//	api.RotateCA()
+package workloadtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/server"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// Server is a running Workload API. The embedded server.Server provides the
+// rotation and expiry controls.
+type Server struct {
+	*server.Server
+
+	ca             *ca.CA
+	addrs          map[spiffeid.ID]string
+	noIdentityAddr string
+}
+
+// New starts a Workload API issuing each of ids, which must share a trust
+// domain, to callers of a socket of its own. It is stopped when the test ends.
+func New(t testing.TB, ids ...string) *Server {
+	t.Helper()
+	if len(ids) == 0 {
+		t.Fatal("workloadtest: at least one SPIFFE ID is required")
+	}
+	parsed := make([]spiffeid.ID, 0, len(ids))
+	for _, id := range ids {
+		parsed = append(parsed, spiffeid.RequireFromString(id))
+	}
+
+	authority, err := ca.New(parsed[0].TrustDomain())
+	if err != nil {
+		t.Fatalf("workloadtest: unable to create CA: %v", err)
+	}
+
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir can
+	// exceed for long test names
+	dir, err := os.MkdirTemp("", "workloadtest")
+	if err != nil {
+		t.Fatalf("workloadtest: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &Server{ca: authority, addrs: map[spiffeid.ID]string{}}
+	var entries []server.Entry
+	sockets := map[string]string{}
+	for i, id := range parsed {
+		socket := filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		entries = append(entries, server.Entry{SPIFFEID: id, Selectors: server.Selectors{Socket: socket}})
+		sockets[socket] = "unix://" + socket
+		s.addrs[id] = "unix://" + socket
+	}
+	none := filepath.Join(dir, "none.sock")
+	sockets[none] = "unix://" + none
+	s.noIdentityAddr = "unix://" + none
+
+	s.Server, err = server.New(server.Config{CA: authority, Entries: entries})
+	if err != nil {
+		t.Fatalf("workloadtest: %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	for socket := range sockets {
+		listener, err := server.Listen(socket)
+		if err != nil {
+			t.Fatalf("workloadtest: unable to listen on %s: %v", socket, err)
+		}
+		go s.Serve(listener)
+	}
+	return s
+}
+
+// Addr returns the Workload API address, as a unix:// URI, at which callers
+// are issued id.
+func (s *Server) Addr(id string) string {
+	addr, ok := s.addrs[spiffeid.RequireFromString(id)]
+	if !ok {
+		panic(fmt.Sprintf("workloadtest: %s is not issued by this server", id))
+	}
+	return addr
+}
+
+// NoIdentityAddr returns a Workload API address at which callers are not
+// issued any identity.
+func (s *Server) NoIdentityAddr() string {
+	return s.noIdentityAddr
+}
+
+// CA returns the test CA, whose bundles verify every issued SVID.
+func (s *Server) CA() *ca.CA {
+	return s.ca
+}
+
+// X509Source returns a source for id, closed when the test ends.
+func (s *Server) X509Source(t testing.TB, id string) *workloadapi.X509Source {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(s.Addr(id))))
+	if err != nil {
+		t.Fatalf("workloadtest: unable to create X509Source for %s: %v", id, err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
@@ -0,0 +1,33 @@
+package workloadtest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+func TestServer(t *testing.T) {
+	api := New(t, "spiffe://example.com/backend", "spiffe://example.com/web")
+
+	source := api.X509Source(t, "spiffe://example.com/web")
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatalf("Failed to get X509-SVID: %v", err)
+	}
+	if svid.ID.String() != "spiffe://example.com/web" {
+		t.Errorf("Expected spiffe://example.com/web, got %s", svid.ID)
+	}
+	if _, _, err := x509svid.Verify(svid.Certificates, api.CA().X509Bundle()); err != nil {
+		t.Errorf("Issued X509-SVID does not verify against the CA: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := workloadapi.FetchX509SVID(ctx, workloadapi.WithAddr(api.NoIdentityAddr())); err == nil || !strings.Contains(err.Error(), "no identity issued") {
+		t.Errorf("Expected no identity issued, got %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/authz"
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// defaultBackendTimeout bounds a call to a backend that sets no timeout.
+const defaultBackendTimeout = 10 * time.Second
+
+// backendNamePattern keeps backend names usable in routes, metric labels and
+// check names.
+var backendNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// BackendConfig is one named backend of the web service, served on
+// /backends/{name}:
+//
+//	backends:
+//	  - name: vm
+//	    url: https://backend-vm.example.com:8443
+//	    spiffe_id: spiffe://example.com/apps/demo/backend
+//	  - name: k8s
+//	    url: https://backend.demo.svc:8443
+//	    spiffe_id: spiffe://example.com/ns/demo/*
+//	    timeout: 5s
+//	    dns:
+//	      type: a
+//	    balancer: least_outstanding
+//	    retry:
+//	      attempt_timeout: 2s
+//	    hedge_delay: 500ms
+//
+// Calls go to the host of url unless endpoints lists the replicas of the
+// backend or dns finds them.
+type BackendConfig struct {
+	Name           string               `yaml:"name"`
+	URL            string               `yaml:"url"`
+	SPIFFEID       string               `yaml:"spiffe_id"`    // Expected SPIFFE ID of the backend, or a rule as for approved clients
+	AuthMode       string               `yaml:"auth_mode"`    // AuthModeX509 (default) or AuthModeJWT
+	JWTAudience    string               `yaml:"jwt_audience"` // Defaults to spiffe_id when it is an exact ID
+	Timeout        time.Duration        `yaml:"timeout"`      // Bounds the whole call, defaults to defaultBackendTimeout
+	Endpoints      []string             `yaml:"endpoints"`    // Static host:port replicas
+	DNS            DiscoveryConfig      `yaml:"dns"`
+	Balancer       string               `yaml:"balancer"` // BalancerRoundRobin (default) or BalancerLeastOutstanding
+	Ejection       EjectionConfig       `yaml:"ejection"`
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	HedgeDelay     time.Duration        `yaml:"hedge_delay"` // Sends an idempotent call again if it has not been answered this soon, 0 disables hedging
+}
+
+// applyDefaults fills in the optional settings left unset.
+func (b *BackendConfig) applyDefaults() {
+	if b.AuthMode == "" {
+		b.AuthMode = AuthModeX509
+	}
+	if b.Timeout == 0 {
+		b.Timeout = defaultBackendTimeout
+	}
+	if b.JWTAudience == "" {
+		if _, err := spiffeid.FromString(b.SPIFFEID); err == nil {
+			b.JWTAudience = b.SPIFFEID
+		}
+	}
+	if b.DNS.Type != "" {
+		if b.DNS.Name == "" {
+			if u, err := url.Parse(b.URL); err == nil {
+				b.DNS.Name = u.Hostname()
+			}
+		}
+		if b.DNS.RefreshInterval == 0 {
+			b.DNS.RefreshInterval = 30 * time.Second
+		}
+	}
+	if b.Balancer == "" {
+		b.Balancer = BalancerRoundRobin
+	}
+	if b.Ejection.ConsecutiveFailures == 0 {
+		b.Ejection.ConsecutiveFailures = 3
+	}
+	if b.Ejection.Duration == 0 {
+		b.Ejection.Duration = 30 * time.Second
+	}
+	if b.Retry.MaxAttempts == 0 {
+		b.Retry.MaxAttempts = 3
+	}
+	if b.Retry.InitialBackoff == 0 {
+		b.Retry.InitialBackoff = 100 * time.Millisecond
+	}
+	if b.Retry.MaxBackoff == 0 {
+		b.Retry.MaxBackoff = time.Second
+	}
+	if b.CircuitBreaker.ConsecutiveFailures == 0 {
+		b.CircuitBreaker.ConsecutiveFailures = 5
+	}
+	if b.CircuitBreaker.OpenDuration == 0 {
+		b.CircuitBreaker.OpenDuration = 30 * time.Second
+	}
+}
+
+// validate returns every invalid setting of the backend.
+func (b BackendConfig) validate() []error {
+	var errs []error
+	if !backendNamePattern.MatchString(b.Name) {
+		errs = append(errs, fmt.Errorf("name %q must consist of lower case letters, digits, - and _", b.Name))
+	}
+	if err := validateBackendURL(b.URL); err != nil {
+		errs = append(errs, fmt.Errorf("url: %w", err))
+	}
+	if rule, err := authz.ParseRule(b.SPIFFEID); err != nil {
+		errs = append(errs, fmt.Errorf("spiffe_id %q: %w", b.SPIFFEID, err))
+	} else if _, err := authz.CompileRules([]authz.Rule{rule}); err != nil {
+		errs = append(errs, fmt.Errorf("spiffe_id %q: %w", b.SPIFFEID, err))
+	}
+	switch b.AuthMode {
+	case AuthModeX509:
+	case AuthModeJWT:
+		if b.JWTAudience == "" {
+			errs = append(errs, errors.New("jwt_audience is required with auth_mode jwt when spiffe_id is a rule"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth_mode: invalid backend auth mode %q: must be %q or %q", b.AuthMode, AuthModeX509, AuthModeJWT))
+	}
+	if b.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %v", b.Timeout))
+	}
+	for _, endpoint := range b.Endpoints {
+		if _, port, err := net.SplitHostPort(endpoint); err != nil || configfile.ValidatePort(port) != nil {
+			errs = append(errs, fmt.Errorf("endpoints: invalid endpoint %q: must be host:port", endpoint))
+		}
+	}
+	switch b.DNS.Type {
+	case "":
+	case DiscoveryA, DiscoverySRV:
+		if len(b.Endpoints) > 0 {
+			errs = append(errs, errors.New("dns cannot be combined with endpoints"))
+		}
+		if b.DNS.RefreshInterval < 0 {
+			errs = append(errs, fmt.Errorf("dns: refresh_interval must not be negative, got %v", b.DNS.RefreshInterval))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("dns: invalid type %q: must be %q or %q", b.DNS.Type, DiscoveryA, DiscoverySRV))
+	}
+	if b.Balancer != BalancerRoundRobin && b.Balancer != BalancerLeastOutstanding {
+		errs = append(errs, fmt.Errorf("balancer: invalid balancer %q: must be %q or %q", b.Balancer, BalancerRoundRobin, BalancerLeastOutstanding))
+	}
+	if b.Ejection.ConsecutiveFailures < 0 || b.Ejection.Duration < 0 {
+		errs = append(errs, errors.New("ejection: consecutive_failures and duration must not be negative"))
+	}
+	switch {
+	case b.Retry.MaxAttempts < 0:
+		errs = append(errs, fmt.Errorf("retry: max_attempts must not be negative, got %d", b.Retry.MaxAttempts))
+	case b.Retry.InitialBackoff < 0 || b.Retry.MaxBackoff < b.Retry.InitialBackoff:
+		errs = append(errs, fmt.Errorf("retry: initial_backoff (%v) must not be negative or exceed max_backoff (%v)", b.Retry.InitialBackoff, b.Retry.MaxBackoff))
+	case b.Retry.AttemptTimeout < 0:
+		errs = append(errs, fmt.Errorf("retry: attempt_timeout must not be negative, got %v", b.Retry.AttemptTimeout))
+	}
+	if b.CircuitBreaker.ConsecutiveFailures < 0 || b.CircuitBreaker.OpenDuration < 0 {
+		errs = append(errs, errors.New("circuit_breaker: consecutive_failures and open_duration must not be negative"))
+	}
+	if b.HedgeDelay < 0 {
+		errs = append(errs, fmt.Errorf("hedge_delay must not be negative, got %v", b.HedgeDelay))
+	}
+	return errs
+}
+
+// validateBackends checks every backend of the registry and that their names
+// are unique.
+func validateBackends(backends []BackendConfig) error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, backend := range backends {
+		for _, err := range backend.validate() {
+			errs = append(errs, fmt.Errorf("backends[%d]: %w", i, err))
+		}
+		if seen[backend.Name] {
+			errs = append(errs, fmt.Errorf("backends[%d]: duplicate name %q", i, backend.Name))
+		}
+		seen[backend.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// backend is a configured backend with the clients that call it.
+type backend struct {
+	BackendConfig
+	pool       *endpointPool
+	resilience *resilientTransport
+	client     *http.Client // Calls on behalf of the UI
+	plain      *http.Client // Calls for /status, sent once without retries, hedging or the circuit breaker
+	probe      *http.Client // Readiness checks, without the metrics or balancing of real calls
+}
+
+// newBackend creates the clients of config, which spread their calls across
+// the endpoints of the backend. Calls on behalf of the UI are retried,
+// hedged and guarded by a circuit breaker as configured. They authenticate with the X509-SVID of
+// source and accept only a backend that config.SPIFFEID authorizes, or in
+// AuthModeJWT present a JWT-SVID from jwtSource over regular TLS. instrument
+// adds logging, tracing and metrics to the client of real calls. With
+// config.DNS the endpoints are resolved until ctx is done.
+func newBackend(ctx context.Context, config BackendConfig, source svidSource, jwtSource jwtsvid.Source, instrument func(http.RoundTripper) http.RoundTripper) (*backend, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", config.Name, err)
+	}
+	addresses := config.Endpoints
+	if len(addresses) == 0 {
+		addresses = []string{u.Host}
+	}
+	b := &backend{BackendConfig: config, pool: newEndpointPool(config.Name, addresses, config.Balancer, config.Ejection)}
+	if config.DNS.Type != "" {
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"https": "443", "http": "80"}[u.Scheme]
+		}
+		go b.pool.discover(ctx, net.DefaultResolver, config.DNS, port)
+	}
+
+	b.resilience = &resilientTransport{
+		backend:    config.Name,
+		retry:      config.Retry,
+		hedgeDelay: config.HedgeDelay,
+		breaker:    newCircuitBreaker(config.Name, config.CircuitBreaker),
+	}
+	var transport http.RoundTripper
+	if config.AuthMode == AuthModeJWT {
+		// Endpoints are dialed by address, so the server certificate is
+		// verified against the host of the URL
+		jwtTransport := http.DefaultTransport.(*http.Transport).Clone()
+		jwtTransport.TLSClientConfig = &tls.Config{ServerName: u.Hostname()}
+		tokens := newJWTTokenCache(jwtSource, config.JWTAudience)
+		b.resilience.base = &bearerTransport{
+			tokens: tokens,
+			base:   &balancedTransport{pool: b.pool, base: instrument(jwtTransport)},
+		}
+		transport = &bearerTransport{tokens: tokens, base: jwtTransport}
+	} else {
+		authorizer, err := authz.Authorizer(config.SPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", config.Name, err)
+		}
+		transport = &http.Transport{TLSClientConfig: tlsconfig.MTLSClientConfig(source, source, authorizer)}
+		b.resilience.base = &balancedTransport{pool: b.pool, base: instrument(transport)}
+	}
+	b.client = &http.Client{Transport: b.resilience, Timeout: config.Timeout}
+	b.plain = &http.Client{Transport: b.resilience.base, Timeout: config.Timeout}
+	b.probe = &http.Client{Transport: transport}
+	return b, nil
+}
+
+// ready probes every endpoint of b in turn until one answers without a 5xx.
+// The probes dial the endpoints directly rather than through the balancer,
+// so that they neither count as calls nor get an endpoint ejected.
+func (b *backend) ready(ctx context.Context) error {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, address := range b.pool.addresses() {
+		target := *u
+		target.Host = address
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Host = u.Host
+		resp, err := b.probe.Do(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s unreachable: %w", address, err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errs = append(errs, fmt.Errorf("%s answered %s", address, resp.Status))
+			continue
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// BackendStatus is the state of the calls to a backend, served on /status.
+type BackendStatus struct {
+	Balancer       string           `json:"balancer"`
+	Endpoints      []EndpointStatus `json:"endpoints"`
+	CircuitBreaker CircuitStatus    `json:"circuit_breaker"`
+	Retries        uint64           `json:"retries"`
+	Hedges         uint64           `json:"hedges"`
+}
+
+func (b *backend) status() BackendStatus {
+	return BackendStatus{
+		Balancer:       b.Balancer,
+		Endpoints:      b.pool.status(),
+		CircuitBreaker: b.resilience.breaker.status(),
+		Retries:        b.resilience.retries.Load(),
+		Hedges:         b.resilience.hedges.Load(),
+	}
+}
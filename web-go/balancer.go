@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancers that choose the endpoint of a backend for each call.
+const (
+	BalancerRoundRobin       = "round_robin"       // Every endpoint in turn (default)
+	BalancerLeastOutstanding = "least_outstanding" // The endpoint with the fewest calls in flight
+)
+
+// Types of DNS discovery of the endpoints of a backend.
+const (
+	DiscoveryA   = "a"   // The addresses of the name, at the port of the backend URL
+	DiscoverySRV = "srv" // The targets and ports of the SRV records of the name
+)
+
+// DiscoveryConfig finds the endpoints of a backend in DNS, such as the
+// replicas behind a headless Kubernetes service.
+type DiscoveryConfig struct {
+	Type            string        `yaml:"type"`             // DiscoveryA or DiscoverySRV, empty to disable
+	Name            string        `yaml:"name"`             // Defaults to the host of the backend URL
+	RefreshInterval time.Duration `yaml:"refresh_interval"` // Defaults to 30s
+}
+
+// EjectionConfig takes an endpoint out of rotation for a while once it
+// failed repeatedly.
+type EjectionConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"` // Defaults to 3
+	Duration            time.Duration `yaml:"duration"`             // Defaults to 30s
+}
+
+// endpointPool balances the calls to a backend across its endpoints. An
+// endpoint is ejected after consecutive failures: calls that fail without a
+// response, such as a TLS handshake with an unexpected peer, and 5xx
+// responses.
+type endpointPool struct {
+	backend  string
+	balancer string
+	ejection EjectionConfig
+	now      func() time.Time
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+type endpoint struct {
+	address             string
+	outstanding         int
+	requests            uint64
+	failures            uint64
+	ejections           uint64
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+func newEndpointPool(backend string, addresses []string, balancer string, ejection EjectionConfig) *endpointPool {
+	p := &endpointPool{backend: backend, balancer: balancer, ejection: ejection, now: time.Now}
+	for _, address := range addresses {
+		p.endpoints = append(p.endpoints, &endpoint{address: address})
+	}
+	return p
+}
+
+// pick chooses the endpoint of the next call and counts the call as
+// outstanding until done. While every endpoint is ejected, it chooses among
+// all of them rather than failing the call.
+func (p *endpointPool) pick() *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if !now.Before(e.ejectedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	// Ties between the least outstanding endpoints go round-robin
+	start := p.next % len(candidates)
+	p.next++
+	chosen := candidates[start]
+	if p.balancer == BalancerLeastOutstanding {
+		for i := 1; i < len(candidates); i++ {
+			if e := candidates[(start+i)%len(candidates)]; e.outstanding < chosen.outstanding {
+				chosen = e
+			}
+		}
+	}
+	chosen.outstanding++
+	chosen.requests++
+	return chosen
+}
+
+// done records the outcome of a call to e.
+func (p *endpointPool) done(e *endpoint, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e.outstanding--
+	if !failed {
+		e.consecutiveFailures = 0
+		return
+	}
+	e.failures++
+	e.consecutiveFailures++
+	if e.consecutiveFailures >= p.ejection.ConsecutiveFailures {
+		e.consecutiveFailures = 0
+		e.ejections++
+		e.ejectedUntil = p.now().Add(p.ejection.Duration)
+		slog.Warn("Ejecting backend endpoint", "backend", p.backend, "endpoint", e.address,
+			"failures", p.ejection.ConsecutiveFailures, "duration", p.ejection.Duration)
+	}
+}
+
+// update replaces the endpoints with addresses, keeping the state of those
+// that remain.
+func (p *endpointPool) update(addresses []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make([]string, 0, len(p.endpoints))
+	known := make(map[string]*endpoint, len(p.endpoints))
+	for _, e := range p.endpoints {
+		current = append(current, e.address)
+		known[e.address] = e
+	}
+	if slices.Equal(current, addresses) {
+		return
+	}
+
+	endpoints := make([]*endpoint, 0, len(addresses))
+	for _, address := range addresses {
+		e, ok := known[address]
+		if !ok {
+			e = &endpoint{address: address}
+		}
+		endpoints = append(endpoints, e)
+	}
+	p.endpoints = endpoints
+	slog.Info("Backend endpoints updated", "backend", p.backend, "endpoints", addresses)
+}
+
+// addresses returns the address of every endpoint, without counting a call.
+func (p *endpointPool) addresses() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addresses := make([]string, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		addresses = append(addresses, e.address)
+	}
+	return addresses
+}
+
+// EndpointStatus is the state of one endpoint of a backend, served on
+// /status.
+type EndpointStatus struct {
+	Address      string     `json:"address"`
+	Ejected      bool       `json:"ejected"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Outstanding  int        `json:"outstanding"`
+	Requests     uint64     `json:"requests"`
+	Failures     uint64     `json:"failures"`
+	Ejections    uint64     `json:"ejections"`
+}
+
+// status returns the state of every endpoint.
+func (p *endpointPool) status() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	statuses := make([]EndpointStatus, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		status := EndpointStatus{
+			Address:     e.address,
+			Outstanding: e.outstanding,
+			Requests:    e.requests,
+			Failures:    e.failures,
+			Ejections:   e.ejections,
+		}
+		if now.Before(e.ejectedUntil) {
+			ejectedUntil := e.ejectedUntil
+			status.Ejected, status.EjectedUntil = true, &ejectedUntil
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// resolver looks up the endpoints of a backend in DNS, such as
+// net.DefaultResolver.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// discover resolves the endpoints described by config right away and then
+// every refresh interval until ctx is done. When resolution fails the
+// current endpoints are kept.
+func (p *endpointPool) discover(ctx context.Context, r resolver, config DiscoveryConfig, port string) {
+	ticker := time.NewTicker(config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		addresses, err := resolveEndpoints(ctx, r, config, port)
+		if err != nil {
+			slog.Warn("Backend endpoint discovery failed, keeping current endpoints",
+				"backend", p.backend, "name", config.Name, "error", err)
+		} else {
+			p.update(addresses)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolveEndpoints returns the sorted host:port endpoints config finds in
+// DNS. A records are combined with port.
+func resolveEndpoints(ctx context.Context, r resolver, config DiscoveryConfig, port string) ([]string, error) {
+	var addresses []string
+	switch config.Type {
+	case DiscoverySRV:
+		_, records, err := r.LookupSRV(ctx, "", "", config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	default:
+		hosts, err := r.LookupHost(ctx, config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addresses = append(addresses, net.JoinHostPort(host, port))
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no endpoints found for %s", config.Name)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// balancedTransport sends every call through base to an endpoint chosen by
+// pool. The Host header keeps the host of the backend URL, and the context
+// of the call the name of the backend, see backendName.
+type balancedTransport struct {
+	pool *endpointPool
+	base http.RoundTripper
+}
+
+type backendNameKey struct{}
+
+// backendName returns the name of the backend that req is sent to by a
+// balancedTransport, or the host of req when it was sent directly.
+func backendName(req *http.Request) string {
+	if name, ok := req.Context().Value(backendNameKey{}).(string); ok {
+		return name
+	}
+	return req.URL.Host
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := t.pool.pick()
+	req = req.Clone(context.WithValue(req.Context(), backendNameKey{}, t.pool.backend))
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	req.URL.Host = e.address
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		// A caller that gave up says nothing about the endpoint
+		t.pool.done(e, req.Context().Err() == nil)
+		return nil, err
+	}
+	failed := resp.StatusCode >= http.StatusInternalServerError
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { t.pool.done(e, failed) }}
+	return resp, nil
+}
+
+// releaseBody calls release once the body is closed, which ends the call for
+// the balancer.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
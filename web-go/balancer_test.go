@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEndpointPoolRoundRobin(t *testing.T) {
+	pool := newEndpointPool("test", []string{"a:443", "b:443", "c:443"}, BalancerRoundRobin, EjectionConfig{ConsecutiveFailures: 1, Duration: time.Minute})
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		e := pool.pick()
+		picked = append(picked, e.address)
+		pool.done(e, false)
+	}
+	if expected := []string{"a:443", "b:443", "c:443", "a:443", "b:443", "c:443"}; !slices.Equal(picked, expected) {
+		t.Errorf("Expected %v, got %v", expected, picked)
+	}
+}
+
+func TestEndpointPoolLeastOutstanding(t *testing.T) {
+	pool := newEndpointPool("test", []string{"a:443", "b:443"}, BalancerLeastOutstanding, EjectionConfig{ConsecutiveFailures: 1, Duration: time.Minute})
+
+	// a is busy with a slow call, so the following calls go to b
+	slow := pool.pick()
+	for i := 0; i < 3; i++ {
+		e := pool.pick()
+		if e.address != "b:443" {
+			t.Errorf("Expected the idle endpoint b:443, got %s", e.address)
+		}
+		pool.done(e, false)
+	}
+	pool.done(slow, false)
+}
+
+func TestEndpointPoolEjection(t *testing.T) {
+	now := time.Now()
+	pool := newEndpointPool("test", []string{"a:443", "b:443"}, BalancerRoundRobin, EjectionConfig{ConsecutiveFailures: 2, Duration: time.Minute})
+	pool.now = func() time.Time { return now }
+
+	// call makes a call to address, with successful calls to the other
+	// endpoints picked on the way
+	call := func(address string, failed bool) {
+		t.Helper()
+		for {
+			e := pool.pick()
+			if e.address == address {
+				pool.done(e, failed)
+				return
+			}
+			pool.done(e, false)
+		}
+	}
+
+	// A success in between resets the count of consecutive failures
+	call("a:443", true)
+	call("a:443", false)
+	call("a:443", true)
+	if status := pool.status(); status[0].Ejected {
+		t.Fatalf("Expected a:443 to stay in rotation, got %+v", status[0])
+	}
+
+	call("a:443", true)
+	status := pool.status()
+	if !status[0].Ejected || status[0].Ejections != 1 || status[0].Failures != 3 {
+		t.Fatalf("Expected a:443 to be ejected after two failures in a row, got %+v", status[0])
+	}
+	for i := 0; i < 4; i++ {
+		e := pool.pick()
+		if e.address != "b:443" {
+			t.Errorf("Expected the ejected endpoint to be skipped, got %s", e.address)
+		}
+		pool.done(e, false)
+	}
+
+	// With every endpoint ejected, calls still go somewhere
+	call("b:443", true)
+	call("b:443", true)
+	e := pool.pick()
+	pool.done(e, false)
+
+	now = now.Add(time.Minute)
+	if status := pool.status(); status[0].Ejected || status[1].Ejected {
+		t.Errorf("Expected the endpoints to return after the ejection, got %+v", status)
+	}
+}
+
+func TestEndpointPoolUpdate(t *testing.T) {
+	pool := newEndpointPool("test", []string{"a:443", "b:443"}, BalancerRoundRobin, EjectionConfig{ConsecutiveFailures: 1, Duration: time.Minute})
+	e := pool.pick()
+	pool.done(e, true)
+
+	pool.update([]string{"a:443", "c:443"})
+	status := pool.status()
+	if len(status) != 2 || status[0].Address != "a:443" || status[1].Address != "c:443" {
+		t.Fatalf("Expected endpoints a:443 and c:443, got %+v", status)
+	}
+	// The state of a remaining endpoint is kept
+	if !status[0].Ejected || status[0].Requests != 1 {
+		t.Errorf("Expected a:443 to remain ejected, got %+v", status[0])
+	}
+}
+
+type fakeResolver struct {
+	hosts []string
+	srv   []*net.SRV
+	err   error
+}
+
+func (r fakeResolver) LookupHost(context.Context, string) ([]string, error) {
+	return r.hosts, r.err
+}
+
+func (r fakeResolver) LookupSRV(context.Context, string, string, string) (string, []*net.SRV, error) {
+	return "", r.srv, r.err
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	r := fakeResolver{
+		hosts: []string{"10.0.0.2", "10.0.0.1"},
+		srv:   []*net.SRV{{Target: "backend-1.backend.demo.svc.", Port: 8443}, {Target: "backend-0.backend.demo.svc.", Port: 8443}},
+	}
+	a, err := resolveEndpoints(context.Background(), r, DiscoveryConfig{Type: DiscoveryA, Name: "backend"}, "8443")
+	if err != nil || !slices.Equal(a, []string{"10.0.0.1:8443", "10.0.0.2:8443"}) {
+		t.Errorf("Unexpected A endpoints %v, %v", a, err)
+	}
+	srv, err := resolveEndpoints(context.Background(), r, DiscoveryConfig{Type: DiscoverySRV, Name: "_https._tcp.backend"}, "")
+	if err != nil || !slices.Equal(srv, []string{"backend-0.backend.demo.svc:8443", "backend-1.backend.demo.svc:8443"}) {
+		t.Errorf("Unexpected SRV endpoints %v, %v", srv, err)
+	}
+
+	// A failed or empty resolution keeps the current endpoints
+	pool := newEndpointPool("test", []string{"backend:8443"}, BalancerRoundRobin, EjectionConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range []resolver{fakeResolver{err: errors.New("no such host")}, fakeResolver{}} {
+		pool.discover(ctx, r, DiscoveryConfig{Type: DiscoveryA, Name: "backend", RefreshInterval: time.Second}, "8443")
+		if status := pool.status(); len(status) != 1 || status[0].Address != "backend:8443" {
+			t.Errorf("Expected the endpoints to be kept, got %+v", status)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/meinsta/workload-id-demo/shared/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// configVersion is the version of the config file format understood by this
+// build.
+const configVersion = 1
+
+// Config is the effective configuration of the web service. It starts from
+// defaultConfig, then the config file, then the WEB_* and BACKEND_*
+// environment variables and finally the command line flags are applied on
+// top:
+//
+//	version: 1
+//	workload_socket: unix:///opt/machine-id/web.sock
+//	backends:
+//	  - name: backend1
+//	    url: https://backend:8443
+//	    spiffe_id: spiffe://example.com/backend
+//
+// Without backends, backend_url, backend_spiffe_id and the other backend
+// settings describe backend1 and backend2, both at the same URL.
+type Config struct {
+	Version             int                      `yaml:"version"`
+	WebSocket           string                   `yaml:"workload_socket"`
+	WebPort             string                   `yaml:"port"`
+	AdminAddr           string                   `yaml:"admin_addr"` // Plain-HTTP listener for probes and build info
+	BackendURL          string                   `yaml:"backend_url"`
+	BackendSPIFFEID     string                   `yaml:"backend_spiffe_id"`
+	Backend1AuthMode    string                   `yaml:"backend1_auth_mode"` // AuthModeX509 or AuthModeJWT
+	Backend2AuthMode    string                   `yaml:"backend2_auth_mode"`
+	JWTAudience         string                   `yaml:"jwt_audience"`          // Audience of JWT-SVIDs sent to the backend, defaults to backend_spiffe_id
+	Backends            []BackendConfig          `yaml:"backends"`              // Named backends, replacing the settings above
+	ShutdownDelay       time.Duration            `yaml:"shutdown_delay"`        // How long /readyz fails before the listener closes, so load balancers deregister
+	ShutdownGracePeriod time.Duration            `yaml:"shutdown_grace_period"` // How long in-flight requests may take to finish on shutdown
+	Watchdog            svidwatch.WatchdogConfig `yaml:"watchdog"`
+	WorkloadAPIWait     workload.WaitConfig      `yaml:"workload_api_wait"`
+	Log                 telemetry.LogConfig      `yaml:"log"`
+	Trace               telemetry.TraceConfig    `yaml:"trace"`
+}
+
+// defaultConfig is used for everything the config file, the environment and
+// the flags leave unset.
+func defaultConfig() Config {
+	return Config{
+		Version:             configVersion,
+		WebSocket:           "unix://testing/.cache/sockets/web.sock", // Repo-local socket for local demo
+		WebPort:             "8080",
+		AdminAddr:           ":9092",
+		BackendURL:          "https://backend:8443",
+		BackendSPIFFEID:     "spiffe://example.com/backend",
+		Backend1AuthMode:    AuthModeX509,
+		Backend2AuthMode:    AuthModeX509,
+		ShutdownDelay:       5 * time.Second,
+		ShutdownGracePeriod: 10 * time.Second,
+		Watchdog:            svidwatch.DefaultWatchdogConfig(),
+		WorkloadAPIWait:     workload.DefaultWaitConfig(),
+		Log:                 telemetry.LogConfig{Format: "text", Level: "info"},
+		Trace:               telemetry.TraceConfig{Exporter: "none", ServiceName: "web-go"},
+	}
+}
+
+// loadConfig builds the effective config from args and the environment. The
+// config file is named by -config or WEB_CONFIG_FILE. checkOnly reports
+// whether -check-config was given.
+func loadConfig(args []string) (config Config, checkOnly bool, err error) {
+	flags := flag.NewFlagSet("web-go", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("WEB_CONFIG_FILE"), "Versioned YAML config file")
+	workloadSocket := flags.String("workload-socket", "", "Workload API socket address")
+	check := flags.Bool("check-config", false, "Print the effective config and exit, non-zero if it is invalid")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+
+	config = defaultConfig()
+	if *configFile != "" {
+		if err := configfile.Load(*configFile, &config, &config.Version, configVersion); err != nil {
+			return config, *check, err
+		}
+	}
+	if err := applyEnv(&config); err != nil {
+		return config, *check, err
+	}
+	if *workloadSocket != "" {
+		config.WebSocket = *workloadSocket
+	}
+	if config.JWTAudience == "" {
+		config.JWTAudience = config.BackendSPIFFEID
+	}
+	for i := range config.Backends {
+		config.Backends[i].applyDefaults()
+	}
+	return config, *check, config.validate()
+}
+
+// applyEnv overrides config with the environment variables that are set.
+func applyEnv(config *Config) error {
+	// WEB_WORKLOAD_SOCKET takes precedence over the shared variable
+	if socket := workload.SocketFromEnv("WORKLOAD_API_SOCKET", "WEB_WORKLOAD_SOCKET"); socket != "" {
+		config.WebSocket = socket
+	}
+	// BACKEND_AUTH_MODE sets the mode of both backends, which the per-backend
+	// variables override
+	if value := os.Getenv("BACKEND_AUTH_MODE"); value != "" {
+		config.Backend1AuthMode, config.Backend2AuthMode = value, value
+	}
+	for key, field := range map[string]*string{
+		"WEB_PORT":             &config.WebPort,
+		"WEB_ADMIN_ADDR":       &config.AdminAddr,
+		"BACKEND_URL":          &config.BackendURL,
+		"BACKEND_SPIFFE_ID":    &config.BackendSPIFFEID,
+		"BACKEND1_AUTH_MODE":   &config.Backend1AuthMode,
+		"BACKEND2_AUTH_MODE":   &config.Backend2AuthMode,
+		"BACKEND_JWT_AUDIENCE": &config.JWTAudience,
+		"WEB_LOG_FORMAT":       &config.Log.Format,
+		"WEB_LOG_LEVEL":        &config.Log.Level,
+		"WEB_TRACE_EXPORTER":   &config.Trace.Exporter,
+	} {
+		if value := os.Getenv(key); value != "" {
+			*field = value
+		}
+	}
+	for key, field := range map[string]*time.Duration{
+		"WEB_SHUTDOWN_DELAY":        &config.ShutdownDelay,
+		"WEB_SHUTDOWN_GRACE_PERIOD": &config.ShutdownGracePeriod,
+	} {
+		if value := os.Getenv(key); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, value)
+			}
+			*field = duration
+		}
+	}
+	if err := svidwatch.ParseWatchdogConfig("WEB", &config.Watchdog); err != nil {
+		return err
+	}
+	return workload.ParseWaitConfig("WEB", &config.WorkloadAPIWait)
+}
+
+// validate reports every invalid setting at once.
+func (c Config) validate() error {
+	var errs []error
+	if err := workloadapi.ValidateAddress(c.WebSocket); err != nil {
+		errs = append(errs, fmt.Errorf("workload_socket %q: %w", c.WebSocket, err))
+	}
+	if err := configfile.ValidatePort(c.WebPort); err != nil {
+		errs = append(errs, fmt.Errorf("port: %w", err))
+	}
+	if err := configfile.ValidateListenAddr(c.AdminAddr); err != nil {
+		errs = append(errs, fmt.Errorf("admin_addr: %w", err))
+	}
+	if len(c.Backends) > 0 {
+		errs = append(errs, validateBackends(c.Backends))
+	} else {
+		if err := validateBackendURL(c.BackendURL); err != nil {
+			errs = append(errs, fmt.Errorf("backend_url: %w", err))
+		}
+		if _, err := spiffeid.FromString(c.BackendSPIFFEID); err != nil {
+			errs = append(errs, fmt.Errorf("backend_spiffe_id %q: %w", c.BackendSPIFFEID, err))
+		}
+		for key, mode := range map[string]string{"backend1_auth_mode": c.Backend1AuthMode, "backend2_auth_mode": c.Backend2AuthMode} {
+			if mode != AuthModeX509 && mode != AuthModeJWT {
+				errs = append(errs, fmt.Errorf("%s: invalid backend auth mode %q: must be %q or %q", key, mode, AuthModeX509, AuthModeJWT))
+			}
+		}
+	}
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_delay must not be negative, got %v", c.ShutdownDelay))
+	}
+	if c.ShutdownGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace_period must not be negative, got %v", c.ShutdownGracePeriod))
+	}
+	if err := c.Watchdog.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("watchdog: %w", err))
+	}
+	if err := c.WorkloadAPIWait.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("workload_api_wait: %w", err))
+	}
+	if _, err := telemetry.NewLogger(io.Discard, c.Log); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if err := c.Trace.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("trace: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// backends returns the configured backends, or backend1 and backend2 as
+// described by backend_url and the other backend settings.
+func (c Config) backends() []BackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	backends := []BackendConfig{
+		{Name: "backend1", URL: c.BackendURL, SPIFFEID: c.BackendSPIFFEID, AuthMode: c.Backend1AuthMode, JWTAudience: c.JWTAudience},
+		{Name: "backend2", URL: c.BackendURL, SPIFFEID: c.BackendSPIFFEID, AuthMode: c.Backend2AuthMode, JWTAudience: c.JWTAudience},
+	}
+	for i := range backends {
+		backends[i].applyDefaults()
+	}
+	return backends
+}
+
+// validateBackendURL checks that raw is an absolute https URL. Plain http
+// would send the JWT-SVID bearer token, or the request without any peer
+// authentication, in the clear.
+func validateBackendURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid URL %q: must be an absolute https URL", raw)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "web.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+version: 1
+backend_url: https://backend.internal:8443
+backend_spiffe_id: spiffe://example.com/ns/prod/sa/backend
+backend2_auth_mode: jwt
+`)
+	t.Setenv("WEB_CONFIG_FILE", path)
+	t.Setenv("WEB_PORT", "9080")
+	config, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config.BackendURL != "https://backend.internal:8443" || config.Backend2AuthMode != AuthModeJWT || config.WebPort != "9080" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	// The JWT audience follows the backend SPIFFE ID unless set
+	if config.JWTAudience != "spiffe://example.com/ns/prod/sa/backend" {
+		t.Errorf("Expected the backend SPIFFE ID as JWT audience, got %s", config.JWTAudience)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, `
+version: 1
+workload_socket: web.sock
+backend_url: backend:8443
+backend_spiffe_id: example.com/backend
+backend1_auth_mode: apikey
+admin_addr: ":http-admin"
+`)
+	_, checkOnly, err := loadConfig([]string{"--check-config", "--config", path})
+	if !checkOnly {
+		t.Error("Expected --check-config to be reported")
+	}
+	if err == nil {
+		t.Fatal("Expected the config to be rejected")
+	}
+	for _, expected := range []string{"workload_socket", "backend_url", "backend_spiffe_id", "backend1_auth_mode", "admin_addr"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to mention %s, got %v", expected, err)
+		}
+	}
+
+	if _, _, err := loadConfig([]string{"-config", writeConfigFile(t, "version: 1\nbackend_urls: []\n")}); err == nil {
+		t.Error("Expected an unknown field to be rejected")
+	}
+}
+
+func TestLoadConfigBackends(t *testing.T) {
+	path := writeConfigFile(t, `
+version: 1
+backends:
+  - name: vm
+    url: https://backend-vm.internal:8443
+    spiffe_id: spiffe://example.com/apps/demo/backend
+  - name: k8s
+    url: https://backend-proxy.internal
+    spiffe_id: spiffe://example.com/ns/demo/*
+    auth_mode: jwt
+    jwt_audience: spiffe://example.com/ns/demo/sa/backend
+    timeout: 3s
+    dns:
+      type: a
+    balancer: least_outstanding
+`)
+	config, _, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	backends := config.backends()
+	if len(backends) != 2 {
+		t.Fatalf("Expected the two configured backends, got %+v", backends)
+	}
+	vm, k8s := backends[0], backends[1]
+	if vm.AuthMode != AuthModeX509 || vm.Timeout != defaultBackendTimeout || vm.JWTAudience != vm.SPIFFEID {
+		t.Errorf("Expected defaults for backend vm, got %+v", vm)
+	}
+	if k8s.AuthMode != AuthModeJWT || k8s.Timeout != 3*time.Second || k8s.JWTAudience != "spiffe://example.com/ns/demo/sa/backend" {
+		t.Errorf("Unexpected backend k8s %+v", k8s)
+	}
+	if vm.Balancer != BalancerRoundRobin || k8s.Balancer != BalancerLeastOutstanding || vm.Ejection.ConsecutiveFailures != 3 {
+		t.Errorf("Unexpected balancing of the backends %+v", backends)
+	}
+	if vm.Retry.MaxAttempts != 3 || vm.Retry.MaxBackoff != time.Second || vm.CircuitBreaker.ConsecutiveFailures != 5 || vm.HedgeDelay != 0 {
+		t.Errorf("Expected default retries and circuit breaker for backend vm, got %+v", vm)
+	}
+	// DNS discovery resolves the host of the URL unless told otherwise
+	if k8s.DNS.Name != "backend-proxy.internal" || k8s.DNS.RefreshInterval != 30*time.Second {
+		t.Errorf("Unexpected DNS discovery of backend k8s %+v", k8s.DNS)
+	}
+
+	// Without backends the legacy settings describe backend1 and backend2
+	config, _, err = loadConfig(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if backends := config.backends(); len(backends) != 2 || backends[0].Name != "backend1" || backends[1].URL != config.BackendURL {
+		t.Errorf("Expected backend1 and backend2 from the legacy settings, got %+v", backends)
+	}
+}
+
+func TestLoadConfigBackendsInvalid(t *testing.T) {
+	path := writeConfigFile(t, `
+version: 1
+backends:
+  - name: VM
+    url: backend:8443
+    spiffe_id: example.com/backend
+  - name: k8s
+    url: https://backend.internal
+    spiffe_id: spiffe://example.com/ns/demo/*
+    auth_mode: jwt
+    timeout: -1s
+  - name: k8s
+    url: http://backend.internal
+    spiffe_id: spiffe://example.com/backend
+  - name: replicas
+    url: https://backend.internal
+    spiffe_id: spiffe://example.com/backend
+    endpoints: [backend-0.internal]
+    dns:
+      type: txt
+    balancer: random
+    retry:
+      max_attempts: -1
+    circuit_breaker:
+      open_duration: -1m
+    hedge_delay: -1s
+`)
+	_, _, err := loadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatal("Expected the config to be rejected")
+	}
+	for _, expected := range []string{
+		`backends[0]: name "VM"`, "backends[0]: url", `backends[0]: spiffe_id "example.com/backend"`,
+		"backends[1]: jwt_audience is required", "timeout must not be negative",
+		`backends[2]: duplicate name "k8s"`, `backends[2]: url: invalid URL "http://backend.internal": must be an absolute https URL`,
+		`backends[3]: endpoints: invalid endpoint "backend-0.internal"`,
+		`backends[3]: dns: invalid type "txt"`, `backends[3]: balancer: invalid balancer "random"`,
+		"backends[3]: retry: max_attempts", "backends[3]: circuit_breaker", "backends[3]: hedge_delay",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to mention %s, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+const (
+	testBackendID = "spiffe://example.com/backend"
+	testWebID     = "spiffe://example.com/web"
+)
+
+// startBackend serves a minimal backend over mTLS with the X509-SVID of
+// testBackendID, accepting only testWebID.
+func startBackend(t *testing.T, api *workloadtest.Server) string {
+	return serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(BackendResponse{SVID: testBackendID, Name: "Backend (test)", Infra: "test"})
+	}))
+}
+
+// serveBackend serves handler like startBackend, with the X509-SVID of id.
+func serveBackend(t *testing.T, api *workloadtest.Server, id string, handler http.Handler) string {
+	source := api.X509Source(t, id)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0",
+		tlsconfig.MTLSServerConfig(source, source, tlsconfig.AuthorizeID(spiffeid.RequireFromString(testWebID))))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	backend := &http.Server{Handler: handler}
+	go backend.Serve(listener)
+	t.Cleanup(func() { backend.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+// freePort returns a TCP port that is free on 127.0.0.1.
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startWeb boots the real web service against api with env and returns its
+// base URL. It is stopped when the test ends.
+func startWeb(t *testing.T, api *workloadtest.Server, env map[string]string) string {
+	t.Helper()
+	url, stop := launchWeb(t, api, env)
+	t.Cleanup(func() {
+		if err := stop(); err != nil {
+			t.Errorf("Web service failed: %v", err)
+		}
+	})
+	return url
+}
+
+// launchWeb boots the web service like startWeb, leaving it to the caller to
+// stop it. stop shuts the service down and returns the error of run.
+func launchWeb(t *testing.T, api *workloadtest.Server, env map[string]string) (string, func() error) {
+	t.Helper()
+	port := freePort(t)
+	t.Setenv("WEB_WORKLOAD_SOCKET", api.Addr(testWebID))
+	t.Setenv("WEB_PORT", fmt.Sprint(port))
+	t.Setenv("WEB_ADMIN_ADDR", fmt.Sprintf("127.0.0.1:%d", freePort(t)))
+	t.Setenv("WEB_SHUTDOWN_DELAY", "0s")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, nil) }()
+	stop := sync.OnceValue(func() error {
+		cancel()
+		return <-done
+	})
+	t.Cleanup(func() { stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "http://" + addr, stop
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Web service exited during startup: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the web service to listen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID, "spiffe://example.com/impostor")
+	backendURL := startBackend(t, api)
+
+	host := strings.TrimPrefix(backendURL, "https://")
+
+	testCases := []struct {
+		name     string
+		expected string
+		status   int
+		metrics  []string
+	}{
+		{"expected_backend", testBackendID, http.StatusOK, []string{
+			`backend_requests_total{backend="backend1",code="200",endpoint="` + host + `",peer_spiffe_id="spiffe://example.com/backend"} 1`,
+			`tls_handshakes_total{backend="backend1",endpoint="` + host + `",reason="",result="success"} 1`,
+		}},
+		// The backend presents a valid SVID, but not the one web-go expects
+		{"unexpected_backend", "spiffe://example.com/impostor", http.StatusServiceUnavailable, []string{
+			`backend_requests_total{backend="backend1",code="error",endpoint="` + host + `",peer_spiffe_id="none"} 1`,
+			`tls_handshakes_total{backend="backend1",endpoint="` + host + `",reason="unauthorized",result="failure"} 1`,
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			web := startWeb(t, api, map[string]string{
+				"BACKEND_URL":       backendURL,
+				"BACKEND_SPIFFE_ID": tc.expected,
+			})
+
+			resp, err := http.Get(web + "/backends/backend1")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+
+			metrics, err := http.Get(web + "/metrics")
+			if err != nil {
+				t.Fatalf("Failed to scrape metrics: %v", err)
+			}
+			body, _ := io.ReadAll(metrics.Body)
+			metrics.Body.Close()
+			for _, line := range append(tc.metrics, `svid_expiry_seconds{spiffe_id="spiffe://example.com/web"}`) {
+				if !strings.Contains(string(body), line) {
+					t.Errorf("Expected metric %s, got:\n%s", line, body)
+				}
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var data struct {
+				Backend1 BackendResponse `json:"backend1"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if data.Backend1.SVID != testBackendID {
+				t.Errorf("Expected backend %s, got %+v", testBackendID, data.Backend1)
+			}
+		})
+	}
+}
+
+func TestBackendRegistry(t *testing.T) {
+	const k8sID = "spiffe://example.com/ns/demo/sa/backend"
+	api := workloadtest.New(t, testBackendID, testWebID, k8sID)
+	backend := func(id, infra string) string {
+		return serveBackend(t, api, id, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(BackendResponse{SVID: id, Infra: infra})
+		}))
+	}
+	vmURL, k8sURL := backend(testBackendID, "vm"), backend(k8sID, "k8s")
+	config := filepath.Join(t.TempDir(), "web.yaml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`
+version: 1
+backends:
+  - name: vm
+    url: %s
+    spiffe_id: %s
+  - name: k8s
+    url: %s
+    spiffe_id: spiffe://example.com/ns/demo/*
+  # Reaches the vm backend, which does not match the rule
+  - name: misrouted
+    url: %s
+    spiffe_id: spiffe://example.com/ns/demo/*
+`, vmURL, testBackendID, k8sURL, vmURL)), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	web := startWeb(t, api, map[string]string{"WEB_CONFIG_FILE": config})
+
+	for name, expected := range map[string]string{"vm": testBackendID, "k8s": k8sID} {
+		resp, err := http.Get(web + "/backends/" + name)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		var data map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode response of %s: %v", name, err)
+		}
+		var backendResp BackendResponse
+		if err := json.Unmarshal(data[name], &backendResp); err != nil {
+			t.Fatalf("Expected the response of %s under its name, got %s: %v", name, data, err)
+		}
+		if backendResp.SVID != expected || backendResp.Infra != name {
+			t.Errorf("Expected backend %s to answer as %s, got %+v", name, expected, backendResp)
+		}
+	}
+
+	for path, status := range map[string]int{
+		"/backends/misrouted": http.StatusServiceUnavailable,
+		"/backends/unknown":   http.StatusNotFound,
+		// The legacy routes are only served without a backend registry
+		"/backend1": http.StatusNotFound,
+	} {
+		resp, err := http.Get(web + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Expected status %d for %s, got %d", status, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBackendRefusal(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	backendURL := serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "forbidden"})
+	}))
+	web := startWeb(t, api, map[string]string{"BACKEND_URL": backendURL, "BACKEND_SPIFFE_ID": testBackendID})
+
+	resp, err := http.Get(web + "/backends/backend1")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden || body["error"] != "forbidden" {
+		t.Errorf("Expected the refusal of the backend, got %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestBackendEndpoints(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	healthy := startBackend(t, api)
+	failing := serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "replica broken", http.StatusInternalServerError)
+	}))
+	healthyAddr, failingAddr := strings.TrimPrefix(healthy, "https://"), strings.TrimPrefix(failing, "https://")
+	config := filepath.Join(t.TempDir(), "web.yaml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`
+version: 1
+backends:
+  - name: replicas
+    url: https://backend.invalid
+    spiffe_id: %s
+    endpoints: [%s, %s]
+    ejection:
+      consecutive_failures: 1
+      duration: 1m
+`, testBackendID, failingAddr, healthyAddr)), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	web := startWeb(t, api, map[string]string{"WEB_CONFIG_FILE": config, "WEB_ADMIN_ADDR": adminAddr})
+
+	// The first call goes to the failing replica, which is then ejected
+	for i, expected := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK, http.StatusOK} {
+		resp, err := http.Get(web + "/backends/replicas")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %d for call %d, got %d", expected, i, resp.StatusCode)
+		}
+	}
+
+	// Readiness probes every endpoint without counting calls or ejecting
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get("http://" + adminAddr + "/readyz")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the healthy endpoint to make the backend ready, got %d", resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(web + "/status")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	endpoints := status.Backends["replicas"].Endpoints
+	if len(endpoints) != 2 {
+		t.Fatalf("Expected the stats of both endpoints, got %+v", status.Backends)
+	}
+	if e := endpoints[0]; e.Address != failingAddr || !e.Ejected || e.Requests != 1 || e.Failures != 1 || e.Ejections != 1 {
+		t.Errorf("Expected the failing endpoint to be ejected, got %+v", e)
+	}
+	if e := endpoints[1]; e.Address != healthyAddr || e.Ejected || e.Requests < 3 || e.Failures != 0 || e.Outstanding != 0 {
+		t.Errorf("Expected the healthy endpoint to serve the other calls, got %+v", e)
+	}
+}
+
+func TestBackendCircuitBreaker(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	var calls atomic.Int32
+	failing := serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "backend broken", http.StatusInternalServerError)
+	}))
+	config := filepath.Join(t.TempDir(), "web.yaml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`
+version: 1
+backends:
+  - name: flaky
+    url: %s
+    spiffe_id: %s
+    circuit_breaker:
+      consecutive_failures: 2
+      open_duration: 1m
+`, failing, testBackendID)), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	web := startWeb(t, api, map[string]string{"WEB_CONFIG_FILE": config})
+
+	// Two failures open the circuit, then calls fail fast
+	for i, expected := range []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		resp, err := http.Get(web + "/backends/flaky")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %d for call %d, got %d", expected, i, resp.StatusCode)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the open circuit to keep calls from the backend, got %d calls", calls.Load())
+	}
+
+	resp, err := http.Get(web + "/status")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if circuit := status.Backends["flaky"].CircuitBreaker; circuit.State != CircuitOpen || circuit.Opens != 1 || circuit.OpenUntil == nil {
+		t.Errorf("Expected the circuit breaker to be open, got %+v", circuit)
+	}
+}
+
+func TestRotations(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	web := startWeb(t, api, map[string]string{"BACKEND_URL": startBackend(t, api)})
+
+	var body struct {
+		Rotations []svidwatch.Rotation `json:"rotations"`
+	}
+	api.RotateSVIDs()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(body.Rotations) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the rotation to be recorded, got %+v", body.Rotations)
+		}
+		time.Sleep(20 * time.Millisecond)
+		resp, err := http.Get(web + "/rotations")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode rotations: %v", err)
+		}
+	}
+
+	startup, rotation := body.Rotations[0], body.Rotations[1]
+	if startup.SPIFFEID != testWebID || startup.OldSerial != "" {
+		t.Errorf("Expected the startup SVID first, got %+v", startup)
+	}
+	if rotation.OldSerial != startup.Serial || rotation.Serial == startup.Serial {
+		t.Errorf("Expected the rotation to replace serial %s, got %+v", startup.Serial, rotation)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	startWeb(t, api, map[string]string{"BACKEND_URL": startBackend(t, api), "WEB_ADMIN_ADDR": adminAddr})
+
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	readiness := func() int {
+		t.Helper()
+		resp, err := http.Get("http://" + adminAddr + "/readyz")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode readiness: %v", err)
+		}
+		return resp.StatusCode
+	}
+	if status := readiness(); status != http.StatusOK {
+		t.Fatalf("Expected a fresh SVID to be ready, got %d %+v", status, body)
+	}
+	for _, check := range []string{"startup", "workload_api", "svid", "trust_bundle", "backend1", "backend2"} {
+		if body.Checks[check] != "ok" {
+			t.Errorf("Expected check %s to pass, got %q", check, body.Checks[check])
+		}
+	}
+
+	// An SVID that lapses without rotation fails readiness
+	api.SetExpired(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for readiness() != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for readiness to fail")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReadinessDuringStartup(t *testing.T) {
+	api := workloadtest.New(t, testWebID)
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	t.Setenv("WEB_WORKLOAD_SOCKET", api.NoIdentityAddr())
+	t.Setenv("WEB_PORT", fmt.Sprint(freePort(t)))
+	t.Setenv("WEB_ADMIN_ADDR", adminAddr)
+	t.Setenv("WEB_WORKLOAD_API_WAIT", "1m")
+
+	// The Workload API issues no SVID, so the web service keeps waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, nil) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + adminAddr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected liveness to pass while waiting for an SVID, got %d", resp.StatusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the admin listener before the SVID, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get("http://" + adminAddr + "/readyz")
+	if err != nil {
+		t.Fatalf("Readiness probe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode readiness: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Checks["startup"] == "ok" {
+		t.Errorf("Expected readiness to fail until the SVID arrives, got %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	started, release := make(chan struct{}), make(chan struct{})
+	backendURL := serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		json.NewEncoder(w).Encode(BackendResponse{SVID: testBackendID})
+	}))
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	web, stop := launchWeb(t, api, map[string]string{
+		"BACKEND_URL":               backendURL,
+		"WEB_ADMIN_ADDR":            adminAddr,
+		"WEB_SHUTDOWN_DELAY":        "500ms",
+		"WEB_SHUTDOWN_GRACE_PERIOD": "5s",
+	})
+
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(web + "/backend1")
+		if err != nil {
+			t.Errorf("Request in flight failed: %v", err)
+		}
+		inFlight <- resp
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+
+	// Readiness fails right away, while the listener stays open for the
+	// shutdown delay
+	addr := strings.TrimPrefix(web, "http://")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + adminAddr + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for readiness to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn, err := net.Dial("tcp", addr); err != nil {
+		t.Errorf("Expected connections to be accepted during the shutdown delay, got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// After the delay no new connections are accepted while draining
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the web service to start draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	if resp := <-inFlight; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request in flight to complete, got %+v", resp)
+	} else {
+		resp.Body.Close()
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"golang.org/x/sync/singleflight"
+)
+
+// Backend authentication modes.
+const (
+	AuthModeX509 = "x509" // mTLS with the web X509-SVID (default)
+	AuthModeJWT  = "jwt"  // JWT-SVID bearer token over regular TLS
+)
+
+// jwtTokenCache fetches JWT-SVIDs for one audience and reuses them until
+// they are past half of their lifetime, so a token is never sent close to
+// its expiry and the Workload API is not called for every request.
+type jwtTokenCache struct {
+	source   jwtsvid.Source
+	audience string
+	now      func() time.Time
+
+	// refresh makes concurrent requests share one Workload API call, which
+	// is made without holding mu
+	refresh singleflight.Group
+
+	mu        sync.Mutex
+	svid      *jwtsvid.SVID
+	refreshAt time.Time
+}
+
+// jwtFetchTimeout bounds a refresh, which outlives the request that started
+// it when that request is canceled.
+const jwtFetchTimeout = 10 * time.Second
+
+func newJWTTokenCache(source jwtsvid.Source, audience string) *jwtTokenCache {
+	return &jwtTokenCache{source: source, audience: audience, now: time.Now}
+}
+
+// Token returns a valid JWT-SVID, fetching a new one when needed.
+func (c *jwtTokenCache) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	svid, refreshAt := c.svid, c.refreshAt
+	c.mu.Unlock()
+	if svid != nil && c.now().Before(refreshAt) {
+		return svid.Marshal(), nil
+	}
+
+	result := c.refresh.DoChan("", func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwtFetchTimeout)
+		defer cancel()
+		return c.fetch(fetchCtx)
+	})
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// fetch gets a new JWT-SVID from the Workload API and caches it.
+func (c *jwtTokenCache) fetch(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	current, refreshAt := c.svid, c.refreshAt
+	c.mu.Unlock()
+
+	// Another caller may have refreshed the token in the meantime
+	now := c.now()
+	if current != nil && now.Before(refreshAt) {
+		return current.Marshal(), nil
+	}
+
+	svid, err := c.source.FetchJWTSVID(ctx, jwtsvid.Params{Audience: c.audience})
+	if err != nil {
+		if current != nil && now.Before(current.Expiry) {
+			// Keep using the old token while it is still valid
+			slog.Warn("JWT-SVID refresh failed, reusing current token", "audience", c.audience, "error", err)
+			return current.Marshal(), nil
+		}
+		return "", fmt.Errorf("unable to fetch JWT-SVID for audience %q: %w", c.audience, err)
+	}
+
+	c.mu.Lock()
+	c.svid = svid
+	c.refreshAt = now.Add(svid.Expiry.Sub(now) / 2)
+	c.mu.Unlock()
+	slog.Info("JWT-SVID fetched", "audience", c.audience, "spiffe_id", svid.ID.String(),
+		"expiry", svid.Expiry.Format(time.RFC3339))
+	return svid.Marshal(), nil
+}
+
+// bearerTransport attaches a JWT-SVID from tokens to every request.
+type bearerTransport struct {
+	tokens *jwtTokenCache
+	base   http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.tokens.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
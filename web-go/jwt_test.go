@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// fakeJWTSource issues JWT-SVIDs with a fixed lifetime and
+// counts how often it was asked.
+type fakeJWTSource struct {
+	issuer   *workloadtest.JWTIssuer
+	lifetime time.Duration
+	fetches  int
+	err      error
+}
+
+func newFakeJWTSource(t *testing.T, lifetime time.Duration) *fakeJWTSource {
+	return &fakeJWTSource{issuer: workloadtest.NewJWTIssuer(t, "example.com"), lifetime: lifetime}
+}
+
+func (s *fakeJWTSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.fetches++
+	token := s.issuer.Sign("spiffe://example.com/web", []string{params.Audience}, time.Now().Add(s.lifetime))
+	return jwtsvid.ParseInsecure(token, []string{params.Audience})
+}
+
+func (s *fakeJWTSource) FetchJWTSVIDs(ctx context.Context, params jwtsvid.Params) ([]*jwtsvid.SVID, error) {
+	svid, err := s.FetchJWTSVID(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return []*jwtsvid.SVID{svid}, nil
+}
+
+func TestJWTTokenCacheRefresh(t *testing.T) {
+	source := newFakeJWTSource(t, 10*time.Minute)
+	cache := newJWTTokenCache(source, "spiffe://example.com/backend")
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	first, err := cache.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch token: %v", err)
+	}
+	now = now.Add(4 * time.Minute)
+	if second, _ := cache.Token(context.Background()); second != first || source.fetches != 1 {
+		t.Errorf("Expected cached token before half of its lifetime, fetched %d times", source.fetches)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := cache.Token(context.Background()); err != nil || source.fetches != 2 {
+		t.Errorf("Expected token to be refreshed after half of its lifetime, fetched %d times (err=%v)", source.fetches, err)
+	}
+
+	// A failed refresh falls back to the still valid token, which was
+	// fetched at the real time and expires 10 minutes after it
+	source.err = errors.New("workload API unavailable")
+	now = now.Add(3 * time.Minute)
+	if _, err := cache.Token(context.Background()); err != nil {
+		t.Errorf("Expected still valid token to be reused, got %v", err)
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := cache.Token(context.Background()); err == nil {
+		t.Error("Expected error once the cached token expired")
+	}
+}
+
+// blockingJWTSource holds every fetch until release is closed.
+type blockingJWTSource struct {
+	*fakeJWTSource
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *blockingJWTSource) FetchJWTSVID(ctx context.Context, params jwtsvid.Params) (*jwtsvid.SVID, error) {
+	s.calls.Add(1)
+	s.started <- struct{}{}
+	<-s.release
+	return s.fakeJWTSource.FetchJWTSVID(ctx, params)
+}
+
+func TestJWTTokenCacheConcurrentRefresh(t *testing.T) {
+	source := &blockingJWTSource{
+		fakeJWTSource: newFakeJWTSource(t, 10*time.Minute),
+		started:       make(chan struct{}, 10),
+		release:       make(chan struct{}),
+	}
+	cache := newJWTTokenCache(source, "spiffe://example.com/backend")
+
+	tokens := make(chan string, 5)
+	for i := 0; i < cap(tokens); i++ {
+		go func() {
+			token, err := cache.Token(context.Background())
+			if err != nil {
+				t.Errorf("Failed to fetch token: %v", err)
+			}
+			tokens <- token
+		}()
+	}
+	<-source.started
+
+	// A caller that gives up does not wait for the pending fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.Token(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled caller to return right away, got %v", err)
+	}
+
+	close(source.release)
+	first := <-tokens
+	for i := 1; i < cap(tokens); i++ {
+		if token := <-tokens; token != first {
+			t.Error("Expected concurrent callers to share one token")
+		}
+	}
+	if calls := source.calls.Load(); calls != 1 {
+		t.Errorf("Expected one Workload API call, got %d", calls)
+	}
+}
+
+func TestBearerTransport(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	cache := newJWTTokenCache(newFakeJWTSource(t, time.Minute), "backend")
+	client := &http.Client{Transport: &bearerTransport{tokens: cache, base: http.DefaultTransport}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	token, _ := cache.Token(context.Background())
+	if header != "Bearer "+token {
+		t.Errorf("Expected bearer token header, got %q", header)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// logRequests logs every request to the web service once it has been served.
+// Browsers present no client certificate, so only the local identity is
+// logged.
+func logRequests(source x509svid.Source, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if svid, err := source.GetX509SVID(); err == nil {
+			attrs = append(attrs, slog.String("local_spiffe_id", svid.ID.String()))
+		}
+		attrs = append(attrs, telemetry.TraceAttrs(r.Context())...)
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logTransport logs every call to a backend made through base, with the
+// identity the backend presented.
+func logTransport(source x509svid.Source, base http.RoundTripper) http.RoundTripper {
+	return &loggingTransport{source: source, base: base}
+}
+
+type loggingTransport struct {
+	source x509svid.Source
+	base   http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("backend", backendName(req)),
+		slog.String("endpoint", req.URL.Host),
+		slog.String("path", req.URL.Path),
+		slog.Duration("latency", time.Since(start)),
+	}
+	if err == nil {
+		attrs = append(attrs, slog.Int("status", resp.StatusCode))
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			cert := resp.TLS.PeerCertificates[0]
+			if id, err := x509svid.IDFromCert(cert); err == nil {
+				attrs = append(attrs, slog.String("peer_spiffe_id", id.String()))
+			}
+			attrs = append(attrs, slog.String("peer_serial", cert.SerialNumber.Text(16)))
+		}
+	}
+	if svid, err := t.source.GetX509SVID(); err == nil {
+		attrs = append(attrs, slog.String("local_spiffe_id", svid.ID.String()))
+	}
+	attrs = append(attrs, telemetry.TraceAttrs(req.Context())...)
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	slog.LogAttrs(req.Context(), level, "backend request", attrs...)
+	return resp, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+func TestLogTransport(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	backendURL := startBackend(t, api)
+	source := api.X509Source(t, testWebID)
+
+	var buf bytes.Buffer
+	logger, err := telemetry.NewLogger(&buf, telemetry.LogConfig{Format: "json", Level: "info"})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(spiffeid.RequireFromString(testBackendID)))
+	client := &http.Client{Transport: logTransport(source, &http.Transport{TLSClientConfig: tlsConfig})}
+	resp, err := client.Get(backendURL + "/whoami")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"msg":             "backend request",
+		"method":          "GET",
+		"path":            "/whoami",
+		"status":          float64(http.StatusOK),
+		"peer_spiffe_id":  testBackendID,
+		"local_spiffe_id": testWebID,
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, record[key])
+		}
+	}
+	if record["peer_serial"] == nil || record["latency"] == nil {
+		t.Errorf("Expected the peer serial and latency, got %v", record)
+	}
+}
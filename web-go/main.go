@@ -4,77 +4,109 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
 
-	"github.com/spiffe/go-spiffe/v2/logger"
-	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/meinsta/workload-id-demo/shared/configfile"
+	"github.com/meinsta/workload-id-demo/shared/health"
+	"github.com/meinsta/workload-id-demo/shared/svidwatch"
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/meinsta/workload-id-demo/shared/workload"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 )
 
-type Config struct {
-	WebSocket        string
-	WebPort          string
-	BackendURL       string
-	BackendSPIFFEID  string
-}
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 type BackendResponse struct {
-	SVID         string `json:"svid"`
-	Name         string `json:"name"`
-	Infra        string `json:"infra"`
+	SVID          string `json:"svid"`
+	Name          string `json:"name"`
+	Infra         string `json:"infra"`
 	AcceptedSVIDs string `json:"acceptedSvids"`
 }
 
 type StatusResponse struct {
-	AuthMethod    string                 `json:"authentication_method"`
-	NoAPIKeys     bool                   `json:"no_api_keys"`
-	CertStatus    map[string]interface{} `json:"certificate_status"`
-	Note          string                 `json:"note"`
+	AuthMethod string                   `json:"authentication_method"`
+	NoAPIKeys  bool                     `json:"no_api_keys"`
+	CertStatus map[string]interface{}   `json:"certificate_status"`
+	Backends   map[string]BackendStatus `json:"backends"`
+	Note       string                   `json:"note"`
 }
 
 func main() {
-	log.Println("🌐 Starting Web Service (AFTER state - Direct SPIFFE, no Ghostunnel)")
-	if err := run(context.Background()); err != nil {
-		log.Fatalf("Web service failed: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:]); err != nil {
+		slog.Error("Web service failed", "error", err)
+		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
-	config := Config{
-		WebSocket:       getWebSocket(),
-		WebPort:         os.Getenv("WEB_PORT"),
-		BackendURL:      os.Getenv("BACKEND_URL"),
-		BackendSPIFFEID: os.Getenv("BACKEND_SPIFFE_ID"),
+// run serves the web service until ctx is done.
+func run(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	config, checkOnly, err := loadConfig(args)
+	if checkOnly {
+		if printErr := configfile.Print(os.Stdout, config); printErr != nil {
+			return printErr
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
 	}
 
-	// Default values
-	if config.WebPort == "" {
-		config.WebPort = "8080"
+	logger, err := telemetry.NewLogger(os.Stderr, config.Log)
+	if err != nil {
+		return err
 	}
-	if config.BackendURL == "" {
-		config.BackendURL = "https://backend:8443"
+	slog.SetDefault(logger)
+	slog.Info("Starting Web Service (AFTER state - Direct SPIFFE, no Ghostunnel)")
+
+	tracerProvider, shutdownTracing, err := telemetry.NewTracerProvider(ctx, os.Stdout, config.Trace, version)
+	if err != nil {
+		return err
 	}
-	if config.BackendSPIFFEID == "" {
-		config.BackendSPIFFEID = "spiffe://example.com/backend"
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}()
+	slog.Info("Configuration - direct mTLS, no Ghostunnel or API keys needed",
+		"web_socket", config.WebSocket,
+		"web_port", config.WebPort)
+	for _, backend := range config.backends() {
+		slog.Info("Backend configured",
+			"backend", backend.Name,
+			"url", backend.URL,
+			"spiffe_id", backend.SPIFFEID,
+			"auth_mode", backend.AuthMode,
+			"timeout", backend.Timeout)
 	}
 
-	log.Printf("Configuration:")
-	log.Printf("  Web socket: %s", config.WebSocket)
-	log.Printf("  Web port: %s", config.WebPort)
-	log.Printf("  Backend URL: %s", config.BackendURL)
-	log.Printf("  Backend SPIFFE ID: %s", config.BackendSPIFFEID)
-	log.Printf("  🔑 Direct mTLS - no Ghostunnel or API keys needed!")
+	// Probes reach the admin listener separately from the UI
+	admin, err := health.Listen(ctx, config.AdminAddr, version, config.WebSocket)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
 
 	// Create SPIFFE X509 source for web client
-	source, err := workloadapi.NewX509Source(ctx,
-		workloadapi.WithClientOptions(workloadapi.WithAddr(config.WebSocket), workloadapi.WithLogger(logger.Std)))
+	source, err := workload.NewX509Source(ctx, config.WebSocket, config.WorkloadAPIWait, logger)
 	if err != nil {
-		return fmt.Errorf("unable to create X509Source: %w", err)
+		return err
 	}
 	defer source.Close()
 
@@ -84,64 +116,136 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("unable to get web SVID: %w", err)
 	}
 
-	log.Printf("✅ Web SVID obtained:")
-	log.Printf("  SPIFFE ID: %s", webSVID.ID.String())
-	log.Printf("  Certificate expires: %s", webSVID.Certificates[0].NotAfter.Format(time.RFC3339))
-	log.Printf("  → Identity proven by certificate, not API key")
+	workload.LogSVID("Web SVID obtained, identity proven by certificate, not API key", webSVID)
 
-	// Create HTTP client with SPIFFE mTLS
-	backendID := spiffeid.RequireFromString(config.BackendSPIFFEID)
-	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(backendID))
-	
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 10 * time.Second,
+	// Federated bundles are exported next to our own
+	bundles, err := workload.WatchX509Bundles(ctx, config.WebSocket, logger)
+	if err != nil {
+		return err
+	}
+	defer bundles.Close()
+	metrics := newMetrics(source, bundles)
+
+	// With WEB_SVID_EXIT_ON_EXPIRY an expired SVID stops the service
+	monitor := svidwatch.Start(ctx, cancel, source, config.Watchdog, metrics.ObserveRotation)
+
+	// JWT-SVIDs authenticate to backends behind TLS-terminating proxies: the
+	// proxy presents a regular server certificate and the token proves our
+	// identity
+	var jwtSource *workloadapi.JWTSource
+	if slices.ContainsFunc(config.backends(), func(b BackendConfig) bool { return b.AuthMode == AuthModeJWT }) {
+		jwtSource, err = workload.NewJWTSource(ctx, config.WebSocket, logger)
+		if err != nil {
+			return err
+		}
+		defer jwtSource.Close()
+		slog.Info("JWT-SVID bearer authentication enabled")
+	}
+
+	// Each backend gets its own clients, authorizing the SPIFFE ID it is
+	// expected to present
+	instrument := func(base http.RoundTripper) http.RoundTripper {
+		return logTransport(source, traceTransport(tracerProvider, source, metrics.instrumentTransport(base)))
+	}
+	var backends []*backend
+	for _, backendConfig := range config.backends() {
+		backend, err := newBackend(ctx, backendConfig, source, jwtSource, instrument)
+		if err != nil {
+			return err
+		}
+		backends = append(backends, backend)
 	}
 
 	// Set up HTTP handlers
-	http.HandleFunc("/backend1", handleBackend(httpClient, config.BackendURL))
-	http.HandleFunc("/backend2", handleBackend(httpClient, config.BackendURL)) // Same backend for demo
-	http.HandleFunc("/status", handleStatus(httpClient, config.BackendURL, source))
-	http.HandleFunc("/", handleIndex)
+	mux := http.NewServeMux()
+	for _, backend := range backends {
+		mux.HandleFunc("/backends/"+backend.Name, handleBackend(backend))
+		// The UI calls the backends of the legacy settings on /backend1 and
+		// /backend2
+		if len(config.Backends) == 0 {
+			mux.HandleFunc("/"+backend.Name, handleBackend(backend))
+		}
+	}
+	mux.HandleFunc("/status", handleStatus(backends, source))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/rotations", monitor.History.Handler())
+	mux.HandleFunc("/", handleIndex)
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("./public/"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+
+	// Readiness probes call the backends without the metrics of real requests
+	admin.AddCheck("svid", func(context.Context) error { return monitor.Watchdog.Ready() })
+	admin.AddCheck("trust_bundle", health.BundleCheck(source))
+	for _, backend := range backends {
+		admin.AddCheck(backend.Name, backend.ready)
+	}
+
+	server := &http.Server{Addr: ":" + config.WebPort, Handler: traceRequests(tracerProvider, source, mux, logRequests(source, mux))}
+	drained := admin.Drain(ctx, server, config.ShutdownDelay, config.ShutdownGracePeriod)
 
-	log.Printf("🚀 Web service listening on :%s", config.WebPort)
-	log.Printf("   Direct SPIFFE mTLS to backend - no proxy needed!")
-	
-	return http.ListenAndServe(":"+config.WebPort, nil)
+	admin.Started()
+	slog.Info("Web service listening, direct SPIFFE mTLS to backend - no proxy needed", "port", config.WebPort)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-drained
+	slog.Info("Web service stopped")
+	return monitor.Err()
 }
 
-func handleBackend(client *http.Client, backendURL string) http.HandlerFunc {
+// maxErrorBody bounds how much of a backend's error response is passed on.
+const maxErrorBody = 64 << 10
+
+// handleBackend calls backend and serves its response under the name of
+// the backend. Error responses are passed on with their status.
+func handleBackend(backend *backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("📡 Backend request - using direct mTLS (no API keys)")
-		
+		slog.Debug("Backend request - using direct mTLS (no API keys)", "backend", backend.Name)
+
 		// Direct HTTPS request with mTLS client certificate
 		// NO Authorization header needed - identity proven by client cert
-		resp, err := client.Get(backendURL)
+		// The request context carries the trace on to the backend
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL, nil)
 		if err != nil {
-			log.Printf("❌ Backend request failed: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid backend URL: %v", err), http.StatusInternalServerError)
+			return
+		}
+		resp, err := backend.client.Do(req)
+		if err != nil {
+			slog.Error("Backend request failed", "backend", backend.Name, "error", err)
 			http.Error(w, fmt.Sprintf("Backend request failed: %v", err), http.StatusServiceUnavailable)
 			return
 		}
 		defer resp.Body.Close()
 
+		// A refusal, like the JSON error the backend sends an unauthorized
+		// caller, is passed on as it is rather than decoded into an empty
+		// response
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			slog.Warn("Backend refused request", "backend", backend.Name, "status", resp.StatusCode)
+			if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, io.LimitReader(resp.Body, maxErrorBody))
+			return
+		}
+
 		var backendResp BackendResponse
 		if err := json.NewDecoder(resp.Body).Decode(&backendResp); err != nil {
-			log.Printf("❌ Failed to decode backend response: %v", err)
+			slog.Error("Failed to decode backend response", "backend", backend.Name, "error", err)
 			http.Error(w, "Failed to decode backend response", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("✅ Backend responded - mTLS authentication successful")
-		
+		slog.Debug("Backend responded - mTLS authentication successful")
+
 		response := map[string]interface{}{
-			"backend1": backendResp,
-			"note":     "Authentication via mTLS client certificate, not API key",
+			backend.Name: backendResp,
+			"note":       "Authentication via mTLS client certificate, not API key",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -149,24 +253,34 @@ func handleBackend(client *http.Client, backendURL string) http.HandlerFunc {
 	}
 }
 
-func handleStatus(client *http.Client, backendURL string, source *workloadapi.X509Source) http.HandlerFunc {
+func handleStatus(backends []*backend, source *workloadapi.X509Source) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("📊 Status request - checking certificate status")
+		slog.Debug("Status request - checking certificate status")
 
 		// Get current web SVID
 		webSVID, err := source.GetX509SVID()
 		if err != nil {
-			log.Printf("❌ Failed to get web SVID: %v", err)
+			slog.Error("Failed to get web SVID", "error", err)
 			http.Error(w, "Failed to get web SVID", http.StatusInternalServerError)
 			return
 		}
 
-		// Try to get backend status via direct mTLS
-		var backendStatus map[string]interface{}
-		whoamiResp, err := client.Get(backendURL + "/whoami")
-		if err == nil {
-			defer whoamiResp.Body.Close()
-			json.NewDecoder(whoamiResp.Body).Decode(&backendStatus)
+		// Try to get the status of every backend via direct mTLS
+		backendStatus := make(map[string]interface{}, len(backends))
+		balancing := make(map[string]BackendStatus, len(backends))
+		for _, backend := range backends {
+			whoamiReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL+"/whoami", nil)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid backend URL: %v", err), http.StatusInternalServerError)
+				return
+			}
+			var whoami map[string]interface{}
+			if whoamiResp, err := backend.plain.Do(whoamiReq); err == nil {
+				json.NewDecoder(whoamiResp.Body).Decode(&whoami)
+				whoamiResp.Body.Close()
+			}
+			backendStatus[backend.Name] = whoami
+			balancing[backend.Name] = backend.status()
 		}
 
 		webNotAfter := webSVID.Certificates[0].NotAfter
@@ -176,12 +290,13 @@ func handleStatus(client *http.Client, backendURL string, source *workloadapi.X5
 			AuthMethod: "Direct mTLS via Teleport Workload Identity",
 			NoAPIKeys:  true,
 			CertStatus: map[string]interface{}{
-				"web_spiffe_id":     webSVID.ID.String(),
-				"web_expires_in":    webExpiresIn.String(),
-				"backend_status":    backendStatus,
-				"auto_rotation":     "managed by tbot",
+				"web_spiffe_id":  webSVID.ID.String(),
+				"web_expires_in": webExpiresIn.String(),
+				"backend_status": backendStatus,
+				"auto_rotation":  "managed by tbot",
 			},
-			Note: "No Ghostunnel needed - direct SPIFFE-to-SPIFFE mTLS",
+			Backends: balancing,
+			Note:     "No Ghostunnel needed - direct SPIFFE-to-SPIFFE mTLS",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -192,13 +307,3 @@ func handleStatus(client *http.Client, backendURL string, source *workloadapi.X5
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "./public/index.html")
 }
-
-func getWebSocket() string {
-	if socket := os.Getenv("WEB_WORKLOAD_SOCKET"); socket != "" {
-		return socket
-	}
-	if socket := os.Getenv("WORKLOAD_API_SOCKET"); socket != "" {
-		return socket
-	}
-	return "unix://testing/.cache/sockets/web.sock"
-}
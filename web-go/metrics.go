@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/meinsta/workload-id-demo/shared/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Metrics exports the web service's identity and its calls to backends to
+// Prometheus, so that alerts can fire before an SVID lapses.
+type Metrics struct {
+	*metrics.Registry
+	handshakes *prometheus.CounterVec
+	requests   *prometheus.CounterVec
+}
+
+// svidSource provides the web service's X509-SVID and trust bundle, such as
+// workloadapi.X509Source.
+type svidSource interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// newMetrics creates the metrics of the web service using source. SVID
+// expiry and the size of every bundle in bundles are read on every scrape.
+func newMetrics(source svidSource, bundles metrics.BundleLister) *Metrics {
+	m := &Metrics{
+		Registry: metrics.NewRegistry(source, bundles),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_handshakes_total",
+			Help: "TLS handshakes with backends by result and failure reason.",
+		}, []string{"backend", "endpoint", "result", "reason"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "backend_requests_total",
+			Help: "Requests to backends by backend SPIFFE ID and status code, or error.",
+		}, []string{"backend", "endpoint", "peer_spiffe_id", "code"}),
+	}
+	m.MustRegister(m.handshakes, m.requests)
+	return m
+}
+
+// instrumentTransport counts the handshakes and requests made through base,
+// labelled with the backend name and the endpoint called.
+func (m *Metrics) instrumentTransport(base http.RoundTripper) http.RoundTripper {
+	return &metricsTransport{metrics: m, base: base}
+}
+
+type metricsTransport struct {
+	metrics *Metrics
+	base    http.RoundTripper
+}
+
+// States of the handshake of a call, see metricsTransport.RoundTrip.
+const (
+	handshakePending int32 = iota // No handshake finished yet, or none at all on a reused connection
+	handshakeDone                 // The handshake succeeded while the call was in flight
+	callDone                      // The call returned; a handshake finishing later is counted right away
+)
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend, endpoint := backendName(req), req.URL.Host
+	// net/http dials apart from the call, so a cancelled call can return
+	// before its handshake finishes and the connection goes to the pool. The
+	// callback then counts the handshake itself.
+	var state atomic.Int32
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			switch {
+			case err != nil:
+				t.metrics.handshakes.WithLabelValues(backend, endpoint, "failure", metrics.HandshakeErrorReason(err)).Inc()
+			case !state.CompareAndSwap(handshakePending, handshakeDone):
+				t.metrics.handshakes.WithLabelValues(backend, endpoint, "success", "").Inc()
+			}
+		},
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	// With TLS 1.3 the backend rejects our certificate after our side of the
+	// handshake completed, so the rejection surfaces on the request
+	if state.Swap(callDone) == handshakeDone {
+		if err != nil && strings.Contains(err.Error(), "remote error: tls") {
+			t.metrics.handshakes.WithLabelValues(backend, endpoint, "failure", metrics.HandshakeErrorReason(err)).Inc()
+		} else {
+			t.metrics.handshakes.WithLabelValues(backend, endpoint, "success", "").Inc()
+		}
+	}
+
+	if err != nil {
+		t.metrics.requests.WithLabelValues(backend, endpoint, "none", "error").Inc()
+		return nil, err
+	}
+	peer := "none"
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		if id, err := x509svid.IDFromCert(resp.TLS.PeerCertificates[0]); err == nil {
+			peer = id.String()
+		}
+	}
+	t.metrics.requests.WithLabelValues(backend, endpoint, peer, strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
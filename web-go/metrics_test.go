@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+)
+
+func TestMetricsTransportHandshakes(t *testing.T) {
+	metrics := newMetrics(nil, x509bundle.NewSet())
+	late := make(chan func(), 1)
+	// Calls are labelled with the backend they are balanced for
+	pool := newEndpointPool("backend1", []string{"backend-0:8443"}, BalancerRoundRobin, EjectionConfig{})
+	transport := &balancedTransport{pool: pool, base: metrics.instrumentTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		trace := httptrace.ContextClientTrace(req.Context())
+		switch req.URL.Path {
+		case "/cancelled":
+			// The dial goes on after the call gave up
+			late <- func() { trace.TLSHandshakeDone(tls.ConnectionState{}, nil) }
+			return nil, context.Canceled
+		case "/rejected":
+			trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
+			return nil, errors.New("remote error: tls: bad certificate")
+		default:
+			trace.TLSHandshakeDone(tls.ConnectionState{}, errors.New("x509: certificate signed by unknown authority"))
+			return nil, errors.New("x509: certificate signed by unknown authority")
+		}
+	}))}
+
+	for _, path := range []string{"/cancelled", "/rejected", "/untrusted"} {
+		req, _ := http.NewRequest(http.MethodGet, "https://backend:8443"+path, nil)
+		if _, err := transport.RoundTrip(req); err == nil {
+			t.Fatalf("Expected %s to fail", path)
+		}
+	}
+	(<-late)()
+
+	expected := `
+# HELP tls_handshakes_total TLS handshakes with backends by result and failure reason.
+# TYPE tls_handshakes_total counter
+tls_handshakes_total{backend="backend1",endpoint="backend-0:8443",reason="",result="success"} 1
+tls_handshakes_total{backend="backend1",endpoint="backend-0:8443",reason="rejected_by_peer",result="failure"} 1
+tls_handshakes_total{backend="backend1",endpoint="backend-0:8443",reason="unknown_authority",result="failure"} 1
+`
+	if err := testutil.CollectAndCompare(metrics.handshakes, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected handshake metrics: %v", err)
+	}
+}
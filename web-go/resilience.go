@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/metrics"
+)
+
+// RetryConfig retries idempotent calls to a backend that could not connect,
+// lost their connection after the TLS handshake or timed out, but never a
+// call whose handshake or authorization failed.
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`    // Including the first, defaults to 3; 1 disables retries
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // Defaults to 100ms, doubling up to max_backoff, with jitter
+	MaxBackoff     time.Duration `yaml:"max_backoff"`     // Defaults to 1s
+	AttemptTimeout time.Duration `yaml:"attempt_timeout"` // Bounds each attempt, 0 leaves only the timeout of the backend
+}
+
+// CircuitBreakerConfig stops calling a backend that keeps failing, so that
+// calls fail fast instead of waiting for their timeout.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"` // Opens after this many failed calls in a row, defaults to 5
+	OpenDuration        time.Duration `yaml:"open_duration"`        // Fails calls fast this long before a trial call, defaults to 30s
+}
+
+// States of a circuit breaker.
+const (
+	CircuitClosed   = "closed"    // Calls go through
+	CircuitOpen     = "open"      // Calls fail fast
+	CircuitHalfOpen = "half_open" // A single trial call decides whether to close
+)
+
+// ErrCircuitOpen fails a call without trying while the backend keeps failing.
+var ErrCircuitOpen = errors.New("circuit breaker open, backend keeps failing")
+
+// circuitBreaker opens after config.ConsecutiveFailures failed calls in a
+// row. Once config.OpenDuration has passed it lets one trial call through,
+// which closes it again or reopens it.
+type circuitBreaker struct {
+	backend string
+	config  CircuitBreakerConfig
+	now     func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+	opens    uint64
+}
+
+func newCircuitBreaker(backend string, config CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{backend: backend, config: config, now: time.Now, state: CircuitClosed}
+}
+
+// allow returns ErrCircuitOpen if a call must fail fast.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen {
+		if b.now().Before(b.openedAt.Add(b.config.OpenDuration)) {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+	}
+	if b.state == CircuitHalfOpen {
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record records the outcome of a call that allow let through.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		if b.state != CircuitClosed {
+			slog.Info("Circuit breaker closed", "backend", b.backend)
+		}
+		b.state, b.failures = CircuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.config.ConsecutiveFailures {
+		b.state, b.openedAt = CircuitOpen, b.now()
+		b.opens++
+		slog.Warn("Circuit breaker open", "backend", b.backend, "failures", b.failures, "duration", b.config.OpenDuration)
+	}
+}
+
+// release ends a call that allow let through without an outcome, because
+// the caller gave up.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// CircuitStatus is the state of the circuit breaker of a backend, served on
+// /status.
+type CircuitStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Opens               uint64     `json:"opens"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+func (b *circuitBreaker) status() CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := CircuitStatus{State: b.state, ConsecutiveFailures: b.failures, Opens: b.opens}
+	if b.state == CircuitOpen {
+		openUntil := b.openedAt.Add(b.config.OpenDuration)
+		status.OpenUntil = &openUntil
+	}
+	return status
+}
+
+// resilientTransport guards the calls to a backend made through base with
+// the circuit breaker, retries idempotent calls as configured by retry and,
+// with a hedge delay, sends a second attempt when the first is slow to
+// answer.
+type resilientTransport struct {
+	backend    string
+	retry      RetryConfig
+	hedgeDelay time.Duration
+	breaker    *circuitBreaker
+	base       http.RoundTripper
+
+	retries atomic.Uint64
+	hedges  atomic.Uint64
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	// Calls that may change state on the backend are sent once
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+	attempts := 1
+	if idempotent {
+		attempts = t.retry.MaxAttempts
+	}
+	backoff := t.retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, handshaken, err := t.attempt(req, idempotent)
+		if req.Context().Err() != nil {
+			// The caller gave up, which says nothing about the backend
+			t.breaker.release()
+			return resp, err
+		}
+		if attempt == attempts || !shouldRetry(resp, handshaken, err) {
+			t.breaker.record(err != nil || resp.StatusCode >= http.StatusInternalServerError)
+			return resp, err
+		}
+
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// Equal jitter keeps at least half of the backoff between attempts
+		wait := backoff/2 + rand.N(backoff/2+1)
+		slog.Warn("Retrying backend call", "backend", t.backend, "attempt", attempt, "retry_in", wait.Truncate(time.Millisecond), "reason", reason)
+		t.retries.Add(1)
+		select {
+		case <-req.Context().Done():
+			t.breaker.release()
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, t.retry.MaxBackoff)
+	}
+}
+
+// attempt sends req through base, bounded by retry.AttemptTimeout. When
+// hedge is set and the hedge delay passes without an answer, it sends req a
+// second time and returns whichever answers first, cancelling the other.
+// handshaken reports whether the try that failed with err got as far as a
+// connection with a completed TLS handshake.
+func (t *resilientTransport) attempt(req *http.Request, hedge bool) (resp *http.Response, handshaken bool, err error) {
+	type result struct {
+		try        int
+		resp       *http.Response
+		handshaken bool
+		err        error
+	}
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if t.retry.AttemptTimeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), t.retry.AttemptTimeout)
+		} else {
+			ctx, cancel = context.WithCancel(req.Context())
+		}
+		// A reused connection completed its handshake for an earlier call
+		var connected atomic.Bool
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if info.Reused {
+					connected.Store(true)
+				}
+			},
+			TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+				if err == nil {
+					connected.Store(true)
+				}
+			},
+		})
+		try := len(cancels)
+		cancels = append(cancels, cancel)
+		go func(req *http.Request) {
+			resp, err := t.base.RoundTrip(req)
+			results <- result{try, resp, connected.Load(), err}
+		}(req.Clone(ctx))
+	}
+	send()
+
+	var hedgeTimer <-chan time.Time
+	if hedge && t.hedgeDelay > 0 {
+		timer := time.NewTimer(t.hedgeDelay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+	for received := 0; received < len(cancels); {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			t.hedges.Add(1)
+			slog.Debug("Hedging slow backend call", "backend", t.backend, "delay", t.hedgeDelay)
+			send()
+		case r := <-results:
+			received++
+			if r.err != nil {
+				cancels[r.try]()
+				handshaken, err = r.handshaken, r.err
+				continue
+			}
+			// The other try is cancelled and its answer discarded
+			for try, cancel := range cancels {
+				if try != r.try {
+					cancel()
+				}
+			}
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if late := <-results; late.err == nil {
+						late.resp.Body.Close()
+					}
+				}
+			}(len(cancels) - received)
+			r.resp.Body = &releaseBody{ReadCloser: r.resp.Body, release: cancels[r.try]}
+			return r.resp, r.handshaken, nil
+		}
+	}
+	return nil, handshaken, err
+}
+
+// shouldRetry reports whether a call that answered resp or failed with err
+// may succeed when tried again.
+func shouldRetry(resp *http.Response, handshaken bool, err error) bool {
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return retryable(err, handshaken)
+}
+
+// retryable reports whether err means the connection was refused or the
+// attempt timed out, or that the connection was reset or closed early after
+// handshaken, its TLS handshake, completed. A reset during the handshake is
+// final like any other TLS failure: it is how a backend may reject the
+// client certificate, and a rejected identity does not change on retry.
+func retryable(err error, handshaken bool) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// Failed verification and alerts from the peer classify differently
+	return handshaken && metrics.HandshakeFailureReason(err.Error()) == "connection_closed"
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker("test", CircuitBreakerConfig{ConsecutiveFailures: 2, OpenDuration: time.Minute})
+	breaker.now = func() time.Time { return now }
+
+	call := func(failed bool) error {
+		t.Helper()
+		if err := breaker.allow(); err != nil {
+			return err
+		}
+		breaker.record(failed)
+		return nil
+	}
+
+	call(true)
+	call(false)
+	call(true)
+	if state := breaker.status().State; state != CircuitClosed {
+		t.Fatalf("Expected a success to reset the failures, got %s", state)
+	}
+	call(true)
+	if status := breaker.status(); status.State != CircuitOpen || status.Opens != 1 || status.OpenUntil == nil {
+		t.Fatalf("Expected the breaker to open after two failures in a row, got %+v", status)
+	}
+	if err := call(false); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected calls to fail fast while open, got %v", err)
+	}
+
+	// After the open duration a single trial call goes through
+	now = now.Add(time.Minute)
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("Expected a trial call, got %v", err)
+	}
+	if err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected a single trial call, got %v", err)
+	}
+	breaker.record(true)
+	if status := breaker.status(); status.State != CircuitOpen || status.Opens != 2 {
+		t.Fatalf("Expected a failed trial to reopen the breaker, got %+v", status)
+	}
+
+	now = now.Add(time.Minute)
+	if err := call(false); err != nil {
+		t.Fatalf("Expected a trial call, got %v", err)
+	}
+	if state := breaker.status().State; state != CircuitClosed {
+		t.Errorf("Expected a successful trial to close the breaker, got %s", state)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newTestTransport returns a resilientTransport that answers calls with
+// answer, given the number of the call starting at 1.
+func newTestTransport(hedgeDelay time.Duration, answer func(ctx context.Context, call int) (int, error)) (*resilientTransport, *atomic.Int32) {
+	var calls atomic.Int32
+	return &resilientTransport{
+		backend:    "test",
+		retry:      RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		hedgeDelay: hedgeDelay,
+		breaker:    newCircuitBreaker("test", CircuitBreakerConfig{ConsecutiveFailures: 5, OpenDuration: time.Minute}),
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			call := int(calls.Add(1))
+			status, err := answer(req.Context(), call)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(fmt.Sprint(call)))}, nil
+		}),
+	}, &calls
+}
+
+func TestResilientTransportRetries(t *testing.T) {
+	reset := fmt.Errorf("read tcp 127.0.0.1:8443: %w", syscall.ECONNRESET)
+	testCases := []struct {
+		name       string
+		method     string
+		handshaken bool
+		errs       []error
+		status     int
+		expected   int32
+	}{
+		{"connection_reset", http.MethodGet, true, []error{reset, reset}, http.StatusOK, 3},
+		// A backend may reject the client certificate by resetting the handshake
+		{"reset_during_handshake", http.MethodGet, false, []error{reset}, 0, 1},
+		{"connection_refused", http.MethodGet, false, []error{syscall.ECONNREFUSED}, http.StatusOK, 2},
+		{"retries_exhausted", http.MethodGet, true, []error{reset, reset, reset}, 0, 3},
+		// The backend presented an identity it is not authorized to have
+		{"unauthorized", http.MethodGet, false, []error{errors.New(`tls: x509svid: could not verify leaf certificate: unexpected ID "spiffe://example.com/impostor"`)}, 0, 1},
+		{"rejected_by_peer", http.MethodGet, true, []error{errors.New("remote error: tls: bad certificate")}, 0, 1},
+		{"not_idempotent", http.MethodPost, true, []error{reset}, 0, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport, calls := newTestTransport(0, func(ctx context.Context, call int) (int, error) {
+				if tc.handshaken {
+					httptrace.ContextClientTrace(ctx).TLSHandshakeDone(tls.ConnectionState{}, nil)
+				}
+				if call <= len(tc.errs) {
+					return 0, tc.errs[call-1]
+				}
+				return http.StatusOK, nil
+			})
+			req, _ := http.NewRequest(tc.method, "https://backend:8443", nil)
+			resp, err := transport.RoundTrip(req)
+			if tc.status == 0 && err == nil {
+				t.Errorf("Expected the call to fail, got %d", resp.StatusCode)
+			}
+			if tc.status != 0 && (err != nil || resp.StatusCode != tc.status) {
+				t.Errorf("Expected status %d, got %v %v", tc.status, resp, err)
+			}
+			if calls.Load() != tc.expected {
+				t.Errorf("Expected %d attempts, got %d", tc.expected, calls.Load())
+			}
+			if retries := transport.retries.Load(); retries != uint64(tc.expected-1) {
+				t.Errorf("Expected %d retries, got %d", tc.expected-1, retries)
+			}
+		})
+	}
+}
+
+func TestResilientTransportHedging(t *testing.T) {
+	// The first attempt hangs until it is cancelled, the hedge answers
+	cancelled := make(chan struct{})
+	transport, calls := newTestTransport(10*time.Millisecond, func(ctx context.Context, call int) (int, error) {
+		if call == 1 {
+			<-ctx.Done()
+			close(cancelled)
+			return 0, ctx.Err()
+		}
+		return http.StatusOK, nil
+	})
+	req, _ := http.NewRequest(http.MethodGet, "https://backend:8443", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected the hedge to answer, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "2" || calls.Load() != 2 || transport.hedges.Load() != 1 {
+		t.Errorf("Expected the answer of the hedge, got %q after %d calls", body, calls.Load())
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the slow attempt to be cancelled")
+	}
+	if state := transport.breaker.status().State; state != CircuitClosed {
+		t.Errorf("Expected the cancelled attempt not to count as a failure, got %s", state)
+	}
+}
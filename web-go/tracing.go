@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/telemetry"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests starts a span for every request to the web service, named
+// after the pattern of routes it matches and continuing the trace of the
+// browser if it sent one.
+func traceRequests(provider trace.TracerProvider, source x509svid.Source, routes telemetry.Router, next http.Handler) http.Handler {
+	annotated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if svid, err := source.GetX509SVID(); err == nil {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("spiffe.local_id", svid.ID.String()))
+		}
+	})
+	return otelhttp.NewHandler(annotated, "web",
+		otelhttp.WithTracerProvider(provider),
+		otelhttp.WithPropagators(telemetry.Propagator),
+		otelhttp.WithSpanNameFormatter(telemetry.RouteSpanName(routes)))
+}
+
+// traceTransport starts a client span for every call to a backend made
+// through base and passes its trace context on in the traceparent header.
+// The span is annotated with both SPIFFE IDs and the timing of the TLS
+// handshake, if the call needed a new connection.
+func traceTransport(provider trace.TracerProvider, source x509svid.Source, base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(&spanTransport{source: source, base: base},
+		otelhttp.WithTracerProvider(provider),
+		otelhttp.WithPropagators(telemetry.Propagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + backendName(r) + r.URL.Path
+		}))
+}
+
+type spanTransport struct {
+	source x509svid.Source
+	base   http.RoundTripper
+}
+
+func (t *spanTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	var handshakeStart time.Time
+	clientTrace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.SetAttributes(attribute.Bool("http.connection.reused", info.Reused))
+		},
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+			span.AddEvent("tls.handshake.start")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			duration := time.Since(handshakeStart)
+			attrs := []attribute.KeyValue{attribute.Float64("tls.handshake.duration_ms", float64(duration)/float64(time.Millisecond))}
+			if err != nil {
+				attrs = append(attrs, attribute.String("tls.handshake.error", err.Error()))
+			}
+			span.AddEvent("tls.handshake.done", trace.WithAttributes(attrs...))
+			span.SetAttributes(attrs...)
+		},
+	}
+	if svid, err := t.source.GetX509SVID(); err == nil {
+		span.SetAttributes(attribute.String("spiffe.local_id", svid.ID.String()))
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		if id, err := x509svid.IDFromCert(resp.TLS.PeerCertificates[0]); err == nil {
+			span.SetAttributes(attribute.String("spiffe.peer_id", id.String()))
+		}
+	}
+	span.SetAttributes(telemetry.TLSAttributes(resp.TLS)...)
+	return resp, nil
+}
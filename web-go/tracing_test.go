@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/meinsta/workload-id-demo/shared/workloadtest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceTransport(t *testing.T) {
+	api := workloadtest.New(t, testBackendID, testWebID)
+	traceparents := make(chan string, 2)
+	backendURL := serveBackend(t, api, testBackendID, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+	}))
+	source := api.X509Source(t, testWebID)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, tlsconfig.AuthorizeID(spiffeid.RequireFromString(testBackendID)))
+	client := &http.Client{Transport: traceTransport(provider, source, &http.Transport{TLSClientConfig: tlsConfig})}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "GET /backend1")
+	traceID := parent.SpanContext().TraceID()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backendURL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	parent.End()
+
+	// The backend continues the trace of the web tier
+	for i := 0; i < 2; i++ {
+		if traceparent := <-traceparents; len(traceparent) != 55 || traceparent[3:35] != traceID.String() {
+			t.Errorf("Expected a traceparent for trace %s, got %q", traceID, traceparent)
+		}
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 2 client spans and their parent, got %d", len(spans))
+	}
+	for i, span := range spans[:2] {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Expected span %d to be a child of the request span", i)
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes() {
+			attrs[attr.Key] = attr.Value
+		}
+		if attrs["spiffe.peer_id"].AsString() != testBackendID || attrs["spiffe.local_id"].AsString() != testWebID {
+			t.Errorf("Expected span %d to carry both SPIFFE IDs, got %v", i, attrs)
+		}
+		// Only the first call makes a handshake, the second reuses its
+		// connection
+		_, handshook := attrs["tls.handshake.duration_ms"]
+		if reused := attrs["http.connection.reused"].AsBool(); handshook == reused {
+			t.Errorf("Expected span %d to have handshake timing only on a new connection, got %v", i, attrs)
+		}
+		if i == 0 && !handshook {
+			t.Errorf("Expected the first call to record the handshake, got %v", attrs)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/server"
+)
+
+// adminState is the JSON form of server.State.
+type adminState struct {
+	X509SVIDTTL string `json:"x509_svid_ttl"`
+	Expired     bool   `json:"expired"`
+	Paused      bool   `json:"paused"`
+}
+
+// newAdminHandler exposes the simulation controls of srv:
+//
+//	GET  /state             current state
+//	POST /rotate            push new X509-SVIDs to every workload now
+//	POST /rotate-ca         rotate the CA and push new bundles and SVIDs
+//	POST /ttl?x509=30s      issue short-lived X509-SVIDs (x509=0 restores)
+//	POST /expire            issue already expired X509-SVIDs
+//	POST /pause             stop responding
+//	POST /resume            respond again
+//	POST /reset             undo ttl, expire and pause
+//
+// Every endpoint responds with the resulting state.
+func newAdminHandler(srv *server.Server) http.Handler {
+	mux := http.NewServeMux()
+	control := func(pattern, message string, change func(r *http.Request) error) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if change != nil {
+				if err := change(r); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				log.Printf("🧪 %s", message)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			state := srv.State()
+			json.NewEncoder(w).Encode(adminState{
+				X509SVIDTTL: state.X509SVIDTTL.String(),
+				Expired:     state.Expired,
+				Paused:      state.Paused,
+			})
+		})
+	}
+
+	control("GET /state", "", nil)
+	control("POST /rotate", "Rotating X509-SVIDs now", func(*http.Request) error {
+		srv.RotateSVIDs()
+		return nil
+	})
+	control("POST /rotate-ca", "Rotated the CA", func(*http.Request) error {
+		return srv.RotateCA()
+	})
+	control("POST /ttl", "Changed the X509-SVID TTL", func(r *http.Request) error {
+		ttl, err := time.ParseDuration(r.URL.Query().Get("x509"))
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("x509 must be a non-negative duration such as 30s")
+		}
+		srv.SetX509SVIDTTL(ttl)
+		return nil
+	})
+	control("POST /expire", "Issuing expired X509-SVIDs", func(*http.Request) error {
+		srv.SetExpired(true)
+		return nil
+	})
+	control("POST /pause", "Stopped responding", func(*http.Request) error {
+		srv.SetPaused(true)
+		return nil
+	})
+	control("POST /resume", "Responding again", func(*http.Request) error {
+		srv.SetPaused(false)
+		return nil
+	})
+	control("POST /reset", "Reset to normal issuance", func(*http.Request) error {
+		srv.Reset()
+		return nil
+	})
+	return mux
+}
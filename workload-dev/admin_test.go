@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/server"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestAdminHandler(t *testing.T) {
+	authority, err := ca.New(spiffeid.RequireTrustDomainFromString("example.com"))
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	srv, err := server.New(server.Config{CA: authority})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer srv.Stop()
+	handler := newAdminHandler(srv)
+
+	testCases := []struct {
+		method, target string
+		status         int
+		expected       adminState
+	}{
+		{http.MethodGet, "/state", http.StatusOK, adminState{X509SVIDTTL: "1h0m0s"}},
+		{http.MethodPost, "/ttl?x509=30s", http.StatusOK, adminState{X509SVIDTTL: "30s"}},
+		{http.MethodPost, "/ttl?x509=soon", http.StatusBadRequest, adminState{}},
+		{http.MethodPost, "/expire", http.StatusOK, adminState{X509SVIDTTL: "30s", Expired: true}},
+		{http.MethodPost, "/pause", http.StatusOK, adminState{X509SVIDTTL: "30s", Expired: true, Paused: true}},
+		{http.MethodPost, "/rotate-ca", http.StatusOK, adminState{X509SVIDTTL: "30s", Expired: true, Paused: true}},
+		{http.MethodGet, "/rotate", http.StatusMethodNotAllowed, adminState{}},
+		{http.MethodPost, "/reset", http.StatusOK, adminState{X509SVIDTTL: "1h0m0s"}},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.target, tc.status, rec.Code)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var state adminState
+		if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+			t.Fatalf("%s %s: invalid response: %v", tc.method, tc.target, err)
+		}
+		if state != tc.expected {
+			t.Errorf("%s %s: expected %+v, got %+v", tc.method, tc.target, tc.expected, state)
+		}
+	}
+
+	if len(authority.X509Bundle().X509Authorities()) != 2 {
+		t.Error("Expected /rotate-ca to rotate the CA")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/server"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML configuration of the development Workload API:
+//
+//	trust_domain: example.com
+//	x509_svid_ttl: 1h
+//	jwt_svid_ttl: 5m
+//	workloads:
+//	  - spiffe_id: spiffe://example.com/backend
+//	    socket: ../testing/.cache/sockets/backend.sock
+//	  - spiffe_id: spiffe://example.com/batch
+//	    socket: ../testing/.cache/sockets/shared.sock
+//	    uid: 1000
+//	    binary: batch
+//
+// Relative socket paths are resolved against the directory of the config
+// file. The server listens on every socket named by a workload plus Sockets.
+type Config struct {
+	TrustDomain string          `yaml:"trust_domain"`
+	CATTL       time.Duration   `yaml:"ca_ttl"`
+	X509SVIDTTL time.Duration   `yaml:"x509_svid_ttl"`
+	JWTSVIDTTL  time.Duration   `yaml:"jwt_svid_ttl"`
+	Sockets     []string        `yaml:"sockets"`
+	Workloads   []WorkloadEntry `yaml:"workloads"`
+}
+
+// WorkloadEntry maps callers matching all given selectors to a SPIFFE ID.
+type WorkloadEntry struct {
+	SPIFFEID string  `yaml:"spiffe_id"`
+	Socket   string  `yaml:"socket"`
+	UID      *uint32 `yaml:"uid"`
+	GID      *uint32 `yaml:"gid"`
+	Binary   string  `yaml:"binary"`
+	Path     string  `yaml:"path"`
+}
+
+// loadConfig reads and validates the config file.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	// Make socket paths independent of the working directory
+	base := filepath.Dir(path)
+	for i, socket := range config.Sockets {
+		config.Sockets[i] = resolveSocket(base, socket)
+	}
+	for i := range config.Workloads {
+		if config.Workloads[i].Socket != "" {
+			config.Workloads[i].Socket = resolveSocket(base, config.Workloads[i].Socket)
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func resolveSocket(base, socket string) string {
+	socket = strings.TrimPrefix(socket, "unix://")
+	if !filepath.IsAbs(socket) {
+		socket = filepath.Join(base, socket)
+	}
+	if abs, err := filepath.Abs(socket); err == nil {
+		return abs
+	}
+	return socket
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	td, err := spiffeid.TrustDomainFromString(c.TrustDomain)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("trust_domain: %w", err))
+	}
+	for name, ttl := range map[string]time.Duration{"ca_ttl": c.CATTL, "x509_svid_ttl": c.X509SVIDTTL, "jwt_svid_ttl": c.JWTSVIDTTL} {
+		if ttl < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if len(c.Workloads) == 0 {
+		errs = append(errs, errors.New("at least one workload is required"))
+	}
+	for i, entry := range c.Workloads {
+		id, err := spiffeid.FromString(entry.SPIFFEID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("workloads[%d].spiffe_id: %w", i, err))
+			continue
+		}
+		if !td.IsZero() && !id.MemberOf(td) {
+			errs = append(errs, fmt.Errorf("workloads[%d].spiffe_id %q is not in trust domain %q", i, id, td))
+		}
+	}
+	if len(c.listenSockets()) == 0 {
+		errs = append(errs, errors.New("no sockets configured"))
+	}
+	return errors.Join(errs...)
+}
+
+// entries converts the workloads into server entries.
+func (c *Config) entries() []server.Entry {
+	entries := make([]server.Entry, 0, len(c.Workloads))
+	for _, workload := range c.Workloads {
+		entries = append(entries, server.Entry{
+			SPIFFEID: spiffeid.RequireFromString(workload.SPIFFEID),
+			Selectors: server.Selectors{
+				Socket: workload.Socket,
+				UID:    workload.UID,
+				GID:    workload.GID,
+				Binary: workload.Binary,
+				Path:   workload.Path,
+			},
+		})
+	}
+	return entries
+}
+
+// listenSockets returns every distinct socket to listen on.
+func (c *Config) listenSockets() []string {
+	seen := map[string]bool{}
+	var sockets []string
+	add := func(socket string) {
+		if socket != "" && !seen[socket] {
+			seen[socket] = true
+			sockets = append(sockets, socket)
+		}
+	}
+	for _, socket := range c.Sockets {
+		add(socket)
+	}
+	for _, workload := range c.Workloads {
+		add(workload.Socket)
+	}
+	return sockets
+}
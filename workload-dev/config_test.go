@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "workload-dev.yaml")
+	if err := os.WriteFile(path, []byte(`
+trust_domain: example.com
+x509_svid_ttl: 2m
+workloads:
+  - spiffe_id: spiffe://example.com/backend
+    socket: sockets/backend.sock
+  - spiffe_id: spiffe://example.com/web
+    socket: unix:///tmp/web.sock
+    uid: 1000
+`), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config.X509SVIDTTL != 2*time.Minute {
+		t.Errorf("Expected x509_svid_ttl 2m, got %v", config.X509SVIDTTL)
+	}
+
+	sockets := config.listenSockets()
+	expected := []string{filepath.Join(dir, "sockets/backend.sock"), "/tmp/web.sock"}
+	if len(sockets) != 2 || sockets[0] != expected[0] || sockets[1] != expected[1] {
+		t.Errorf("Expected sockets %v, got %v", expected, sockets)
+	}
+
+	entries := config.entries()
+	if entries[1].Selectors.UID == nil || *entries[1].Selectors.UID != 1000 {
+		t.Errorf("Expected uid selector 1000, got %v", entries[1].Selectors.UID)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workload-dev.yaml")
+	if err := os.WriteFile(path, []byte(`
+trust_domain: example.com
+workloads:
+  - spiffe_id: spiffe://other.org/web
+    socket: web.sock
+  - spiffe_id: not-an-id
+`), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatal("Expected invalid config to be rejected")
+	}
+	for _, want := range []string{"workloads[0]", "workloads[1]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to mention %s, got %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+module github.com/meinsta/workload-id-demo/workload-dev
+
+go 1.24.0
+
+require (
+	github.com/meinsta/workload-id-demo/shared v0.0.0
+	github.com/spiffe/go-spiffe/v2 v2.8.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-jose/go-jose/v4 v4.1.5 // indirect
+	golang.org/x/net v0.48.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/text v0.32.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
+	google.golang.org/grpc v1.79.3 // indirect
+	google.golang.org/protobuf v1.36.12 // indirect
+)
+
+replace github.com/meinsta/workload-id-demo/shared => ../shared
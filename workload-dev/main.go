@@ -0,0 +1,138 @@
+// workload-dev serves the SPIFFE Workload API from an in-memory CA so that
+// backend and web-go can run fully offline, without tbot or a Teleport
+// cluster.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/ca"
+	"github.com/meinsta/workload-id-demo/shared/workloaddev/server"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func main() {
+	log.Println("🧪 Starting development Workload API (in-memory CA, no Teleport needed)")
+	if err := run(context.Background()); err != nil {
+		log.Fatalf("Workload API failed: %v", err)
+	}
+}
+
+func run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	configPath := flag.String("config", getEnvDefault("WORKLOAD_DEV_CONFIG", "workload-dev.yaml"), "Path to the YAML config file")
+	adminAddr := flag.String("admin", getEnvDefault("WORKLOAD_DEV_ADMIN_ADDR", "localhost:8099"), "Address of the admin HTTP endpoint controlling rotation, empty to disable")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	var caOpts []ca.Option
+	if config.CATTL > 0 {
+		caOpts = append(caOpts, ca.WithTTL(config.CATTL))
+	}
+	authority, err := ca.New(spiffeid.RequireTrustDomainFromString(config.TrustDomain), caOpts...)
+	if err != nil {
+		return err
+	}
+
+	srv, err := server.New(server.Config{
+		CA:          authority,
+		Entries:     config.entries(),
+		X509SVIDTTL: config.X509SVIDTTL,
+		JWTSVIDTTL:  config.JWTSVIDTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Configuration:")
+	log.Printf("  Trust domain: %s", config.TrustDomain)
+	log.Printf("  X509-SVID TTL: %v, JWT-SVID TTL: %v", durationOr(config.X509SVIDTTL, server.DefaultX509SVIDTTL), durationOr(config.JWTSVIDTTL, server.DefaultJWTSVIDTTL))
+	for _, workload := range config.Workloads {
+		log.Printf("  Workload %s (socket=%q uid=%v gid=%v binary=%q path=%q)",
+			workload.SPIFFEID, workload.Socket, deref(workload.UID), deref(workload.GID), workload.Binary, workload.Path)
+	}
+
+	errCh := make(chan error, len(config.listenSockets())+1)
+	for _, socket := range config.listenSockets() {
+		listener, err := server.Listen(socket)
+		if err != nil {
+			srv.Stop()
+			return fmt.Errorf("unable to listen on %s: %w", socket, err)
+		}
+		log.Printf("🔌 Serving Workload API on unix://%s", socket)
+		go func() { errCh <- srv.Serve(listener) }()
+	}
+
+	if *adminAddr != "" {
+		listener, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			srv.Stop()
+			return fmt.Errorf("unable to listen on %s: %w", *adminAddr, err)
+		}
+		admin := &http.Server{Handler: newAdminHandler(srv)}
+		defer admin.Close()
+		go func() {
+			if err := admin.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("admin endpoint failed: %w", err)
+			}
+		}()
+		log.Printf("🧪 Serving admin controls on http://%s (POST /rotate, /rotate-ca, /ttl?x509=30s, /expire, /pause, /resume, /reset)", *adminAddr)
+	}
+
+	// SIGHUP rotates the X509-SVIDs of every connected workload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.Println("🧪 SIGHUP received, rotating X509-SVIDs now")
+			srv.RotateSVIDs()
+		case <-ctx.Done():
+			log.Println("Shutting down")
+			srv.Stop()
+			return nil
+		case err := <-errCh:
+			srv.Stop()
+			return err
+		}
+	}
+}
+
+func getEnvDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func durationOr(value, defaultValue time.Duration) time.Duration {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func deref(value *uint32) any {
+	if value == nil {
+		return "*"
+	}
+	return *value
+}